@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"slices"
 
 	"github.com/link00000000/gwsn/internal/services"
 	"golang.org/x/sync/errgroup"
@@ -55,15 +56,17 @@ func (svcs *ServiceContainer) shutdownServices() error {
 }
 
 type Application struct {
-	svcs             ServiceContainer
-	logger           *slog.Logger
-	shutdownRequests chan *shutdownRequest
+	svcs              ServiceContainer
+	notificationSinks map[string]services.NotificationSink
+	logger            *slog.Logger
+	shutdownRequests  chan *shutdownRequest
 }
 
 var instance *Application = &Application{
-	svcs:             ServiceContainer{},
-	logger:           slog.Default(),
-	shutdownRequests: make(chan *shutdownRequest),
+	svcs:              ServiceContainer{},
+	notificationSinks: make(map[string]services.NotificationSink),
+	logger:            slog.Default(),
+	shutdownRequests:  make(chan *shutdownRequest),
 }
 
 func RegisterGmailService(svc services.GmailService) {
@@ -90,6 +93,23 @@ func NotificationService() services.NotificationService {
 	return instance.svcs.notification
 }
 
+// Registers an additional destination that notifications can be routed to by
+// name.
+func RegisterNotificationSink(name string, sink services.NotificationSink) {
+	instance.notificationSinks[name] = sink
+}
+
+// Returns the sink registered under name. An empty name selects the
+// notification service.
+func NotificationSink(name string) (services.NotificationSink, bool) {
+	if name == "" {
+		return instance.svcs.notification, true
+	}
+
+	sink, ok := instance.notificationSinks[name]
+	return sink, ok
+}
+
 func RegisterSystemTrayService(svc services.SystemTrayService) {
 	instance.svcs.systemTray = svc
 }
@@ -98,6 +118,28 @@ func SystemTrayService() services.SystemTrayService {
 	return instance.svcs.systemTray
 }
 
+// Returns the union of the OAuth scopes that the registered Google services
+// need for the named account.
+func GoogleScopes(account string) []string {
+	scopes := make([]string, 0)
+
+	for _, svc := range []services.GoogleService{instance.svcs.gmail, instance.svcs.googleCalendar} {
+		if svc == nil {
+			continue
+		}
+
+		for _, s := range svc.Scopes(account) {
+			if !slices.Contains(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+
+	slices.Sort(scopes)
+
+	return scopes
+}
+
 func ConfigureLogger(logger *slog.Logger) {
 	instance.logger = logger
 }
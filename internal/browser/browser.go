@@ -0,0 +1,30 @@
+package browser
+
+// Opens urls somewhere the user can see them. Lets callers swap out the system
+// browser, such as in tests.
+type Opener interface {
+	Open(url string) error
+}
+
+type systemOpener struct{}
+
+func (systemOpener) Open(url string) error {
+	return Open(url)
+}
+
+// Opener that uses the user's default web browser.
+var System Opener = systemOpener{}
+
+// Opens url in the user's default web browser.
+func Open(url string) error {
+	cmd := command(url)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Reap the opener process in the background, it exits once the url has been
+	// handed off to the browser.
+	go cmd.Wait()
+
+	return nil
+}
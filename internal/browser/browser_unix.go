@@ -0,0 +1,9 @@
+//go:build unix && !darwin
+
+package browser
+
+import "os/exec"
+
+func command(url string) *exec.Cmd {
+	return exec.Command("xdg-open", url)
+}
@@ -2,13 +2,51 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
 	"time"
 
 	"github.com/link00000000/gwsn/internal/app"
 )
 
+type GmailRuleMatchConfig struct {
+	From           []string
+	To             []string
+	Cc             []string
+	Subject        string
+	Labels         []string
+	ListId         string
+	HasAttachments *bool
+}
+
+type GmailRuleActionConfig struct {
+	// One of "notify" or "mute". Defaults to "notify".
+	Type   string
+	Urgent bool
+	// One of "none", "beep" or "alert". Empty for the default sound.
+	Sound string
+	// Path to an image file
+	Icon string
+	// Name of a notification sink
+	Sink string
+}
+
+type GmailRuleConfig struct {
+	Name   string
+	Match  GmailRuleMatchConfig
+	Action GmailRuleActionConfig
+}
+
+type GmailDigestConfig struct {
+	// How long messages are collected after the first one arrives
+	Window time.Duration
+	// Sends the digest early once this many messages were collected. 0 for no
+	// limit.
+	MaxMessages int
+}
+
 type GmailAccountConfig struct {
 	Name         string
 	TokenType    string
@@ -16,15 +54,123 @@ type GmailAccountConfig struct {
 	RefreshToken string
 	Expiry       string
 	ExpiresIn    int
+	AuthFlow     string
+
+	// One of "file", "encryptedFile" or "keyring". Defaults to "file".
+	TokenStore           string
+	TokenStorePassphrase string
+
+	// Label ids or names, including Gmail's CATEGORY_* labels. Only messages with
+	// one of IncludeLabels and none of ExcludeLabels are notified. IncludeLabels
+	// defaults to INBOX.
+	IncludeLabels []string
+	ExcludeLabels []string
+
+	// Evaluated before the rules in GmailConfig
+	Rules []GmailRuleConfig
+
+	// Summarizes messages in one notification instead of notifying each thread.
+	// nil to disable.
+	Digest *GmailDigestConfig
 }
 
 type GmailConfig struct {
 	Accounts        []GmailAccountConfig
 	PollingInterval time.Duration
+
+	// Maximum number of notifications for messages received in a single poll,
+	// such as after the app was not running for a while. 0 for no limit.
+	MaxCatchUpMessages int
+
+	// Number of messages fetched in a single batch request, at most 100
+	BatchSize int
+	// Maximum number of requests in flight while fetching messages
+	MaxConcurrentRequests int
+
+	// New messages of a thread arriving within this long of the previous one
+	// update the same notification
+	ThreadCoalesceWindow time.Duration
+
+	// Decide which messages notify and how. The first matching rule wins.
+	Rules []GmailRuleConfig
+
+	// Buttons shown on notifications, any of "markRead", "archive", "star" and
+	// "trash". None by default, as they need permission to modify the mailbox.
+	NotificationActions []string
+}
+
+type NotificationSinkConfig struct {
+	Name string
+	// One of "desktop", "log" or "webhook"
+	Type string
+	// Only used by webhook sinks
+	Url string
+}
+
+type NotificationsConfig struct {
+	Sinks []NotificationSinkConfig
+}
+
+type DndPeriodConfig struct {
+	// Weekday names, such as "mon" or "monday"
+	Days []string
+	// Times of day as HH:MM. Periods ending before they start run past midnight.
+	Start string
+	End   string
+}
+
+type DndConfig struct {
+	// IANA timezone name, such as "Europe/Berlin". Defaults to the local
+	// timezone.
+	Timezone   string
+	QuietHours []DndPeriodConfig
+
+	// Case-insensitive substrings of sender addresses that bypass quiet hours
+	VipSenders []string
+	// Gmail label ids that bypass quiet hours
+	VipLabels []string
+}
+
+type CalendarConfig struct {
+	// Names of the accounts in GmailConfig whose calendars are watched
+	Accounts        []string
+	PollingInterval time.Duration
+	// How far ahead events are fetched
+	Lookahead time.Duration
+	// Changes to events further ahead than this are not notified. Zero notifies
+	// changes to any upcoming event.
+	ChangeHorizon time.Duration
 }
 
 type Config struct {
-	Gmail GmailConfig
+	Gmail         GmailConfig
+	Calendar      CalendarConfig
+	Notifications NotificationsConfig
+	Dnd           DndConfig
+}
+
+// Logs the config with the tokens and passphrases of accounts redacted.
+func (cfg *Config) LogValue() slog.Value {
+	redacted := *cfg
+	redacted.Gmail.Accounts = make([]GmailAccountConfig, len(cfg.Gmail.Accounts))
+
+	for i, acc := range cfg.Gmail.Accounts {
+		acc.AccessToken = redact(acc.AccessToken)
+		acc.RefreshToken = redact(acc.RefreshToken)
+		acc.TokenStorePassphrase = redact(acc.TokenStorePassphrase)
+		redacted.Gmail.Accounts[i] = acc
+	}
+
+	return slog.AnyValue(redacted)
+}
+
+// Hides a secret while still showing whether it was set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return "[redacted]"
 }
 
 type ConfigProvider interface {
@@ -51,9 +197,35 @@ func Build(providers ...ConfigProvider) (*Config, error) {
 
 	app.Logger().Debug("Finished building config", "config", cfg)
 
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// Account names become part of file names, state keys and notification keys,
+// so they are limited to characters that are safe in all of them
+var accountNamePattern = regexp.MustCompile(`^[A-Za-z0-9@+_-][A-Za-z0-9@+_.-]{0,63}$`)
+
+func (cfg *Config) validate() error {
+	names := make(map[string]bool, len(cfg.Gmail.Accounts))
+
+	for _, acc := range cfg.Gmail.Accounts {
+		if !accountNamePattern.MatchString(acc.Name) {
+			return fmt.Errorf("invalid account name %q: must be 1 to 64 letters, digits or any of @+_.- and must not start with a dot", acc.Name)
+		}
+
+		if names[acc.Name] {
+			return fmt.Errorf("duplicate account name %q", acc.Name)
+		}
+
+		names[acc.Name] = true
+	}
+
+	return nil
+}
+
 type filePathType string
 
 const (
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestConfigLogValueRedactsSecrets(t *testing.T) {
+	cfg := &Config{
+		Gmail: GmailConfig{
+			Accounts: []GmailAccountConfig{{
+				Name:                 "work",
+				AccessToken:          "secret-access-token",
+				RefreshToken:         "secret-refresh-token",
+				TokenStore:           "encryptedFile",
+				TokenStorePassphrase: "secret-passphrase",
+			}},
+		},
+	}
+
+	for _, h := range []func(*bytes.Buffer) slog.Handler{
+		func(b *bytes.Buffer) slog.Handler { return slog.NewTextHandler(b, nil) },
+		func(b *bytes.Buffer) slog.Handler { return slog.NewJSONHandler(b, nil) },
+	} {
+		var buf bytes.Buffer
+		slog.New(h(&buf)).Info("config", "config", cfg)
+
+		out := buf.String()
+		if strings.Contains(out, "secret-") {
+			t.Errorf("logged config contains a secret: %s", out)
+		}
+
+		if !strings.Contains(out, "work") || !strings.Contains(out, "encryptedFile") {
+			t.Errorf("logged config is missing non-secret fields: %s", out)
+		}
+	}
+
+	if cfg.Gmail.Accounts[0].AccessToken != "secret-access-token" {
+		t.Error("logging the config changed its accounts")
+	}
+}
@@ -18,15 +18,55 @@ type GmailAccountInMemoryConfig struct {
 	RefreshToken *string
 	Expiry       *string
 	ExpiresIn    *int
+	AuthFlow     *string
+
+	TokenStore           *string
+	TokenStorePassphrase *string
+
+	IncludeLabels *[]string
+	ExcludeLabels *[]string
+
+	Rules  *[]GmailRuleConfig
+	Digest *GmailDigestConfig
 }
 
 type GmailInMemoryConfig struct {
-	Accounts        *[]GmailAccountInMemoryConfig
+	Accounts           *[]GmailAccountInMemoryConfig
+	PollingInterval    *time.Duration
+	MaxCatchUpMessages *int
+
+	BatchSize             *int
+	MaxConcurrentRequests *int
+
+	ThreadCoalesceWindow *time.Duration
+
+	Rules               *[]GmailRuleConfig
+	NotificationActions *[]string
+}
+
+type NotificationsInMemoryConfig struct {
+	Sinks *[]NotificationSinkConfig
+}
+
+type DndInMemoryConfig struct {
+	Timezone   *string
+	QuietHours *[]DndPeriodConfig
+	VipSenders *[]string
+	VipLabels  *[]string
+}
+
+type CalendarInMemoryConfig struct {
+	Accounts        *[]string
 	PollingInterval *time.Duration
+	Lookahead       *time.Duration
+	ChangeHorizon   *time.Duration
 }
 
 type InMemoryConfig struct {
-	Gmail *GmailInMemoryConfig
+	Gmail         *GmailInMemoryConfig
+	Calendar      *CalendarInMemoryConfig
+	Notifications *NotificationsInMemoryConfig
+	Dnd           *DndInMemoryConfig
 }
 
 func NewInMemoryConfigProvider(cfg *InMemoryConfig) *InMemoryConfigProvider {
@@ -55,10 +95,44 @@ func (p *InMemoryConfigProvider) Apply(cfg *Config) error {
 				applyProp(&targetAccount.RefreshToken, acc.RefreshToken)
 				applyProp(&targetAccount.Expiry, acc.Expiry)
 				applyProp(&targetAccount.ExpiresIn, acc.ExpiresIn)
+				applyProp(&targetAccount.AuthFlow, acc.AuthFlow)
+				applyProp(&targetAccount.TokenStore, acc.TokenStore)
+				applyProp(&targetAccount.TokenStorePassphrase, acc.TokenStorePassphrase)
+				applyProp(&targetAccount.IncludeLabels, acc.IncludeLabels)
+				applyProp(&targetAccount.ExcludeLabels, acc.ExcludeLabels)
+				applyProp(&targetAccount.Rules, acc.Rules)
+
+				if acc.Digest != nil {
+					targetAccount.Digest = acc.Digest
+				}
 			}
 		}
 
 		applyProp(&cfg.Gmail.PollingInterval, p.cfg.Gmail.PollingInterval)
+		applyProp(&cfg.Gmail.MaxCatchUpMessages, p.cfg.Gmail.MaxCatchUpMessages)
+		applyProp(&cfg.Gmail.BatchSize, p.cfg.Gmail.BatchSize)
+		applyProp(&cfg.Gmail.MaxConcurrentRequests, p.cfg.Gmail.MaxConcurrentRequests)
+		applyProp(&cfg.Gmail.ThreadCoalesceWindow, p.cfg.Gmail.ThreadCoalesceWindow)
+		applyProp(&cfg.Gmail.Rules, p.cfg.Gmail.Rules)
+		applyProp(&cfg.Gmail.NotificationActions, p.cfg.Gmail.NotificationActions)
+	}
+
+	if p.cfg.Calendar != nil {
+		applyProp(&cfg.Calendar.Accounts, p.cfg.Calendar.Accounts)
+		applyProp(&cfg.Calendar.PollingInterval, p.cfg.Calendar.PollingInterval)
+		applyProp(&cfg.Calendar.Lookahead, p.cfg.Calendar.Lookahead)
+		applyProp(&cfg.Calendar.ChangeHorizon, p.cfg.Calendar.ChangeHorizon)
+	}
+
+	if p.cfg.Notifications != nil {
+		applyProp(&cfg.Notifications.Sinks, p.cfg.Notifications.Sinks)
+	}
+
+	if p.cfg.Dnd != nil {
+		applyProp(&cfg.Dnd.Timezone, p.cfg.Dnd.Timezone)
+		applyProp(&cfg.Dnd.QuietHours, p.cfg.Dnd.QuietHours)
+		applyProp(&cfg.Dnd.VipSenders, p.cfg.Dnd.VipSenders)
+		applyProp(&cfg.Dnd.VipLabels, p.cfg.Dnd.VipLabels)
 	}
 
 	return nil
@@ -30,6 +30,47 @@ func (d *JSONDuration) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type gmailRuleMatchJsonConfig struct {
+	From           []string `json:"from"`
+	To             []string `json:"to"`
+	Cc             []string `json:"cc"`
+	Subject        string   `json:"subject"`
+	Labels         []string `json:"labels"`
+	ListId         string   `json:"listId"`
+	HasAttachments *bool    `json:"hasAttachments"`
+}
+
+type gmailRuleActionJsonConfig struct {
+	Type   string `json:"type"`
+	Urgent bool   `json:"urgent"`
+	Sound  string `json:"sound"`
+	Icon   string `json:"icon"`
+	Sink   string `json:"sink"`
+}
+
+type gmailRuleJsonConfig struct {
+	Name   string                    `json:"name"`
+	Match  gmailRuleMatchJsonConfig  `json:"match"`
+	Action gmailRuleActionJsonConfig `json:"action"`
+}
+
+func convertGmailRules(rules *[]gmailRuleJsonConfig) *[]GmailRuleConfig {
+	if rules == nil {
+		return nil
+	}
+
+	converted := make([]GmailRuleConfig, len(*rules))
+	for i, r := range *rules {
+		converted[i] = GmailRuleConfig{
+			Name:   r.Name,
+			Match:  GmailRuleMatchConfig(r.Match),
+			Action: GmailRuleActionConfig(r.Action),
+		}
+	}
+
+	return &converted
+}
+
 type gmailAccountJsonConfig struct {
 	Name         *string `json:"name"`
 	TokenType    *string `json:"tokenType"`
@@ -37,15 +78,72 @@ type gmailAccountJsonConfig struct {
 	RefreshToken *string `json:"refreshToken"`
 	Expiry       *string `json:"expiry"`
 	ExpiresIn    *int    `json:"expiresIn"`
+	AuthFlow     *string `json:"authFlow"`
+
+	TokenStore           *string `json:"tokenStore"`
+	TokenStorePassphrase *string `json:"tokenStorePassphrase"`
+
+	IncludeLabels *[]string `json:"includeLabels"`
+	ExcludeLabels *[]string `json:"excludeLabels"`
+
+	Rules  *[]gmailRuleJsonConfig `json:"rules"`
+	Digest *gmailDigestJsonConfig `json:"digest"`
+}
+
+type gmailDigestJsonConfig struct {
+	Window      JSONDuration `json:"window"`
+	MaxMessages int          `json:"maxMessages"`
 }
 
 type gmailJsonConfig struct {
-	Accounts        *[]gmailAccountJsonConfig `json:"accounts"`
-	PollingInterval *JSONDuration             `json:"pollingIntervalSeconds"`
+	Accounts           *[]gmailAccountJsonConfig `json:"accounts"`
+	PollingInterval    *JSONDuration             `json:"pollingIntervalSeconds"`
+	MaxCatchUpMessages *int                      `json:"maxCatchUpMessages"`
+
+	BatchSize             *int `json:"batchSize"`
+	MaxConcurrentRequests *int `json:"maxConcurrentRequests"`
+
+	ThreadCoalesceWindow *JSONDuration `json:"threadCoalesceWindow"`
+
+	Rules               *[]gmailRuleJsonConfig `json:"rules"`
+	NotificationActions *[]string              `json:"notificationActions"`
+}
+
+type notificationSinkJsonConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Url  string `json:"url"`
+}
+
+type notificationsJsonConfig struct {
+	Sinks *[]notificationSinkJsonConfig `json:"sinks"`
+}
+
+type dndPeriodJsonConfig struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+type dndJsonConfig struct {
+	Timezone   *string                `json:"timezone"`
+	QuietHours *[]dndPeriodJsonConfig `json:"quietHours"`
+	VipSenders *[]string              `json:"vipSenders"`
+	VipLabels  *[]string              `json:"vipLabels"`
+}
+
+type calendarJsonConfig struct {
+	Accounts        *[]string     `json:"accounts"`
+	PollingInterval *JSONDuration `json:"pollingInterval"`
+	Lookahead       *JSONDuration `json:"lookahead"`
+	ChangeHorizon   *JSONDuration `json:"changeHorizon"`
 }
 
 type jsonConfig struct {
-	Gmail *gmailJsonConfig `json:"gmail"`
+	Gmail         *gmailJsonConfig         `json:"gmail"`
+	Calendar      *calendarJsonConfig      `json:"calendar"`
+	Notifications *notificationsJsonConfig `json:"notifications"`
+	Dnd           *dndJsonConfig           `json:"doNotDisturb"`
 }
 
 type JsonConfigProvider struct {
@@ -103,10 +201,60 @@ func (p *JsonConfigProvider) Apply(cfg *Config) error {
 				applyProp(&targetAccount.RefreshToken, acc.RefreshToken)
 				applyProp(&targetAccount.Expiry, acc.Expiry)
 				applyProp(&targetAccount.ExpiresIn, acc.ExpiresIn)
+				applyProp(&targetAccount.AuthFlow, acc.AuthFlow)
+				applyProp(&targetAccount.TokenStore, acc.TokenStore)
+				applyProp(&targetAccount.TokenStorePassphrase, acc.TokenStorePassphrase)
+				applyProp(&targetAccount.IncludeLabels, acc.IncludeLabels)
+				applyProp(&targetAccount.ExcludeLabels, acc.ExcludeLabels)
+				applyProp(&targetAccount.Rules, convertGmailRules(acc.Rules))
+
+				if acc.Digest != nil {
+					targetAccount.Digest = &GmailDigestConfig{
+						Window:      time.Duration(acc.Digest.Window),
+						MaxMessages: acc.Digest.MaxMessages,
+					}
+				}
 			}
 		}
 
 		applyProp(&cfg.Gmail.PollingInterval, (*time.Duration)(jsonCfg.Gmail.PollingInterval))
+		applyProp(&cfg.Gmail.MaxCatchUpMessages, jsonCfg.Gmail.MaxCatchUpMessages)
+		applyProp(&cfg.Gmail.BatchSize, jsonCfg.Gmail.BatchSize)
+		applyProp(&cfg.Gmail.MaxConcurrentRequests, jsonCfg.Gmail.MaxConcurrentRequests)
+		applyProp(&cfg.Gmail.ThreadCoalesceWindow, (*time.Duration)(jsonCfg.Gmail.ThreadCoalesceWindow))
+		applyProp(&cfg.Gmail.Rules, convertGmailRules(jsonCfg.Gmail.Rules))
+		applyProp(&cfg.Gmail.NotificationActions, jsonCfg.Gmail.NotificationActions)
+	}
+
+	if jsonCfg.Calendar != nil {
+		applyProp(&cfg.Calendar.Accounts, jsonCfg.Calendar.Accounts)
+		applyProp(&cfg.Calendar.PollingInterval, (*time.Duration)(jsonCfg.Calendar.PollingInterval))
+		applyProp(&cfg.Calendar.Lookahead, (*time.Duration)(jsonCfg.Calendar.Lookahead))
+		applyProp(&cfg.Calendar.ChangeHorizon, (*time.Duration)(jsonCfg.Calendar.ChangeHorizon))
+	}
+
+	if jsonCfg.Notifications != nil && jsonCfg.Notifications.Sinks != nil {
+		sinks := make([]NotificationSinkConfig, len(*jsonCfg.Notifications.Sinks))
+		for i, s := range *jsonCfg.Notifications.Sinks {
+			sinks[i] = NotificationSinkConfig(s)
+		}
+
+		cfg.Notifications.Sinks = sinks
+	}
+
+	if jsonCfg.Dnd != nil {
+		applyProp(&cfg.Dnd.Timezone, jsonCfg.Dnd.Timezone)
+		applyProp(&cfg.Dnd.VipSenders, jsonCfg.Dnd.VipSenders)
+		applyProp(&cfg.Dnd.VipLabels, jsonCfg.Dnd.VipLabels)
+
+		if jsonCfg.Dnd.QuietHours != nil {
+			periods := make([]DndPeriodConfig, len(*jsonCfg.Dnd.QuietHours))
+			for i, p := range *jsonCfg.Dnd.QuietHours {
+				periods[i] = DndPeriodConfig(p)
+			}
+
+			cfg.Dnd.QuietHours = periods
+		}
 	}
 
 	return nil
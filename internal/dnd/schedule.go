@@ -0,0 +1,96 @@
+package dnd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Quiet hours on some days of the week. Periods that end before they start
+// run past midnight into the next day, periods that start and end at the same
+// time last the whole day.
+type Period struct {
+	Days []time.Weekday
+
+	// Since midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// Weekly quiet hours in a timezone.
+type Schedule struct {
+	// Defaults to the local timezone
+	Location *time.Location
+	Periods  []Period
+}
+
+// Reports whether t falls inside any of the quiet hours.
+func (s *Schedule) IsQuiet(t time.Time) bool {
+	if s == nil {
+		return false
+	}
+
+	loc := s.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	// Wall clock time, so that periods keep their hours across daylight saving
+	// changes
+	t = t.In(loc)
+	day := t.Weekday()
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	prevDay := (day + 6) % 7
+
+	for _, p := range s.Periods {
+		switch {
+		case p.Start == p.End:
+			if slices.Contains(p.Days, day) {
+				return true
+			}
+
+		case p.Start < p.End:
+			if slices.Contains(p.Days, day) && clock >= p.Start && clock < p.End {
+				return true
+			}
+
+		default:
+			if slices.Contains(p.Days, day) && clock >= p.Start {
+				return true
+			}
+
+			if slices.Contains(p.Days, prevDay) && clock < p.End {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Parses a time of day such as "09:00" or "18:30" into the duration since
+// midnight.
+func ParseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Parses a weekday by its English name or the first three letters of it, such
+// as "monday" or "Mon".
+func ParseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(s)
+
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
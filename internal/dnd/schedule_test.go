@@ -0,0 +1,174 @@
+package dnd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleIsQuiet(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("timezone database unavailable: %v", err)
+	}
+
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+	// 2026-03-02 is a Monday
+	at := func(day int, hour int, min int, loc *time.Location) time.Time {
+		return time.Date(2026, time.March, 2+day, hour, min, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		t        time.Time
+		want     bool
+	}{
+		{
+			name: "nil schedule",
+			t:    at(0, 12, 0, time.UTC),
+		},
+		{
+			name:     "inside daytime period",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 12 * time.Hour, End: 13 * time.Hour}}},
+			t:        at(0, 12, 30, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "end is exclusive",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 12 * time.Hour, End: 13 * time.Hour}}},
+			t:        at(0, 13, 0, time.UTC),
+		},
+		{
+			name:     "start is inclusive",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 12 * time.Hour, End: 13 * time.Hour}}},
+			t:        at(0, 12, 0, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "other day",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 12 * time.Hour, End: 13 * time.Hour}}},
+			t:        at(5, 12, 30, time.UTC),
+		},
+		{
+			name:     "overnight before midnight",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			t:        at(0, 23, 30, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "overnight after midnight",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			t:        at(1, 6, 59, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "overnight ended",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			t:        at(1, 7, 0, time.UTC),
+		},
+		{
+			name:     "overnight carries friday into saturday",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			t:        at(5, 3, 0, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "overnight doesn't start on saturday",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			t:        at(5, 23, 0, time.UTC),
+		},
+		{
+			name:     "overnight doesn't carry saturday into sunday",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: weekdays, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			t:        at(6, 3, 0, time.UTC),
+		},
+		{
+			name:     "overnight carries sunday into monday",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: []time.Weekday{time.Sunday}, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			t:        at(7, 3, 0, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "all day",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: []time.Weekday{time.Saturday, time.Sunday}}}},
+			t:        at(6, 15, 0, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "all day on other day",
+			schedule: &Schedule{Location: time.UTC, Periods: []Period{{Days: []time.Weekday{time.Saturday, time.Sunday}}}},
+			t:        at(7, 0, 0, time.UTC),
+		},
+		{
+			name:     "converted to schedule timezone",
+			schedule: &Schedule{Location: newYork, Periods: []Period{{Days: weekdays, Start: 22 * time.Hour, End: 7 * time.Hour}}},
+			// 23:30 on Monday in New York
+			t:    at(1, 4, 30, time.UTC),
+			want: true,
+		},
+		{
+			name:     "converted to schedule timezone across days",
+			schedule: &Schedule{Location: newYork, Periods: []Period{{Days: weekdays, Start: 9 * time.Hour, End: 17 * time.Hour}}},
+			// 20:00 on Sunday in New York
+			t: at(0, 1, 0, time.UTC),
+		},
+		{
+			name:     "wall clock after daylight saving change",
+			schedule: &Schedule{Location: newYork, Periods: []Period{{Days: weekdays, Start: 9 * time.Hour, End: 17 * time.Hour}}},
+			// 09:30 in New York on the Monday after clocks went forward
+			t:    time.Date(2026, time.March, 9, 13, 30, 0, 0, time.UTC),
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.IsQuiet(tt.t); got != tt.want {
+				t.Errorf("IsQuiet(%s) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "00:00", want: 0},
+		{s: "09:30", want: 9*time.Hour + 30*time.Minute},
+		{s: "23:59", want: 23*time.Hour + 59*time.Minute},
+		{s: "24:00", wantErr: true},
+		{s: "9am", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseClock(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseClock(%q) = %v, %v, want %v, error %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Weekday
+		wantErr bool
+	}{
+		{s: "monday", want: time.Monday},
+		{s: "Sun", want: time.Sunday},
+		{s: "SATURDAY", want: time.Saturday},
+		{s: "tues", wantErr: true},
+		{s: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseWeekday(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseWeekday(%q) = %v, %v, want %v, error %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
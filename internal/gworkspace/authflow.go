@@ -0,0 +1,34 @@
+package gworkspace
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// Obtains a new oauth token by asking the user to authorize the application.
+// opts are added to the authorization request.
+type AuthFlow interface {
+	Token(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+}
+
+type AuthFlowType string
+
+const (
+	AuthFlowType_Loopback AuthFlowType = "loopback"
+	AuthFlowType_Device   AuthFlowType = "device"
+)
+
+// Creates the auth flow for the given type. An empty type selects the loopback
+// flow. prompt is only used by the device flow, if nil the user code is logged.
+func NewAuthFlow(t AuthFlowType, prompt DevicePromptFunc) (AuthFlow, error) {
+	switch t {
+	case "", AuthFlowType_Loopback:
+		return newLoopbackFlow(), nil
+	case AuthFlowType_Device:
+		return newDeviceFlow(prompt), nil
+	default:
+		return nil, fmt.Errorf("unknown auth flow type: %s", t)
+	}
+}
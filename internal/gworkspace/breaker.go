@@ -0,0 +1,190 @@
+package gworkspace
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open, google api is degraded")
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCooldown         = time.Minute * 2
+)
+
+type CircuitState int
+
+const (
+	CircuitState_Closed CircuitState = iota
+	// Requests are rejected until the cooldown has passed
+	CircuitState_Open
+	// A single trial request is allowed through to decide whether to close again
+	CircuitState_HalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitState_Closed:
+		return "closed"
+	case CircuitState_Open:
+		return "open"
+	case CircuitState_HalfOpen:
+		return "halfOpen"
+	default:
+		return "unknown"
+	}
+}
+
+// Stops sending requests to an api after it has failed repeatedly, giving it
+// time to recover.
+type CircuitBreaker struct {
+	mu sync.Mutex
+	// Held while calling listeners
+	notifyMu sync.Mutex
+
+	name             string
+	failureThreshold int
+	cooldown         time.Duration
+
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	trialing bool
+
+	listeners []func(CircuitState)
+}
+
+func NewCircuitBreaker(name string) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:             name,
+		failureThreshold: defaultBreakerFailureThreshold,
+		cooldown:         defaultBreakerCooldown,
+		state:            CircuitState_Closed,
+	}
+}
+
+// Registers fn to be called whenever the state changes. fn is called without
+// the breaker being locked, with the state at the time of the call.
+func (b *CircuitBreaker) OnStateChange(fn func(CircuitState)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listeners = append(b.listeners, fn)
+}
+
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Returns ErrCircuitOpen if the request should not be sent.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+
+	var err error
+	changed := false
+
+	switch b.state {
+	case CircuitState_Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			err = ErrCircuitOpen
+			break
+		}
+
+		changed = b.setState(CircuitState_HalfOpen)
+		b.trialing = true
+
+	case CircuitState_HalfOpen:
+		if b.trialing {
+			err = ErrCircuitOpen
+			break
+		}
+
+		b.trialing = true
+	}
+
+	b.mu.Unlock()
+
+	if changed {
+		b.notifyListeners()
+	}
+
+	return err
+}
+
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+
+	b.failures = 0
+	b.trialing = false
+	changed := b.setState(CircuitState_Closed)
+
+	b.mu.Unlock()
+
+	if changed {
+		b.notifyListeners()
+	}
+}
+
+func (b *CircuitBreaker) RecordFailure() {
+	b.mu.Lock()
+
+	b.failures++
+	b.trialing = false
+
+	changed := false
+	if b.state == CircuitState_HalfOpen || b.failures >= b.failureThreshold {
+		b.openedAt = time.Now()
+		changed = b.setState(CircuitState_Open)
+	}
+
+	b.mu.Unlock()
+
+	if changed {
+		b.notifyListeners()
+	}
+}
+
+// Ends a request that was allowed through without judging the api by it, such
+// as one canceled by its caller, so that a trial request can be sent again.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trialing = false
+}
+
+// Must be called with b.mu held. Returns whether the state changed, in which
+// case notifyListeners must be called once b.mu is released.
+func (b *CircuitBreaker) setState(state CircuitState) bool {
+	if b.state == state {
+		return false
+	}
+
+	slog.Info("circuit breaker changed state", "name", b.name, "from", b.state, "to", state)
+	b.state = state
+
+	return true
+}
+
+// Calls the listeners with the current state. Serialized, so that listeners
+// see changes in order and the last call always reports the latest state, even
+// when changes race.
+func (b *CircuitBreaker) notifyListeners() {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+
+	b.mu.Lock()
+	state := b.state
+	listeners := slices.Clone(b.listeners)
+	b.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(state)
+	}
+}
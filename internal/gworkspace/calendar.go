@@ -0,0 +1,540 @@
+package gworkspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/state"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// Full syncs fetch this much further ahead than the lookahead, so that they
+	// are only needed once a day and a whole day is always known
+	calendarWindowSlack = time.Hour * 24
+)
+
+type CalendarMonitorOptions struct {
+	UpdateFreq time.Duration
+	// How far ahead of now Events returns events
+	Lookahead time.Duration
+
+	// Persists the sync token and events of every calendar under StateKey, so
+	// that a restart continues with an incremental sync. May be nil.
+	State    state.Store
+	StateKey string
+}
+
+type CalendarChangeType string
+
+const (
+	CalendarChangeType_Added   CalendarChangeType = "added"
+	CalendarChangeType_Changed CalendarChangeType = "changed"
+	CalendarChangeType_Deleted CalendarChangeType = "deleted"
+)
+
+type CalendarChange struct {
+	Type CalendarChangeType
+	// The event after the change. For deleted events, the last known version
+	// with Status set to "cancelled".
+	Event *CalendarEvent
+	// The event before the change, nil for added events
+	Previous *CalendarEvent
+}
+
+// Sync position and local copy of the events of a single calendar. Replaced as
+// a whole by every sync, never modified once shared.
+type calendarSyncState struct {
+	SyncToken string `json:"syncToken"`
+	// Events starting after this are not known, a full sync is needed once the
+	// lookahead reaches past it
+	WindowEnd time.Time `json:"windowEnd"`
+	// By event id
+	Events map[string]*CalendarEvent `json:"events"`
+}
+
+// Persisted in CalendarMonitorOptions.State
+type calendarMonitorState struct {
+	// By calendar id
+	Calendars map[string]*calendarSyncState `json:"calendars"`
+}
+
+// Keeps a local copy of the upcoming events of every calendar the user has
+// selected in the Calendar web client, using incremental sync to only fetch
+// what changed.
+// See https://developers.google.com/calendar/api/guides/sync
+type CalendarMonitor struct {
+	// Serializes refreshes, so that changes are computed and sent in order.
+	// Held while fetching, unlike mu.
+	syncMu sync.Mutex
+
+	mu   sync.Mutex
+	svc  *calendar.Service
+	opts CalendarMonitorOptions
+
+	calendars map[string]*Calendar
+	syncs     map[string]*calendarSyncState
+
+	// Wakes Watch to refresh before the next tick
+	refreshRequests chan struct{}
+
+	subs calendarSubscribers
+}
+
+func NewCalendarMonitor(svc *calendar.Service, opts CalendarMonitorOptions) *CalendarMonitor {
+	return &CalendarMonitor{
+		svc:       svc,
+		opts:      opts,
+		calendars: make(map[string]*Calendar),
+		syncs:     make(map[string]*calendarSyncState),
+
+		refreshRequests: make(chan struct{}, 1),
+	}
+}
+
+// Restores the sync state saved by a previous run.
+func (c *CalendarMonitor) Initialize() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.opts.State == nil {
+		return
+	}
+
+	s := calendarMonitorState{}
+	if _, err := c.opts.State.Load(c.opts.StateKey, &s); err != nil {
+		slog.Warn("failed to restore calendar sync state, starting with a full sync", "key", c.opts.StateKey, "error", err)
+		return
+	}
+
+	if s.Calendars != nil {
+		c.syncs = s.Calendars
+	}
+}
+
+func (c *CalendarMonitor) Watch(ctx context.Context) error {
+	ticker := time.NewTicker(c.opts.UpdateFreq)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Refresh(ctx); err != nil {
+				slog.Error("error while syncing calendar events", "error", err)
+			}
+
+		case <-c.refreshRequests:
+			if err := c.Refresh(ctx); err != nil {
+				slog.Error("error while syncing calendar events", "error", err)
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Makes Watch refresh as soon as it can without waiting for the refresh.
+// Requests made while one is pending are merged.
+func (c *CalendarMonitor) RequestRefresh() {
+	select {
+	case c.refreshRequests <- struct{}{}:
+	default:
+	}
+}
+
+// Syncs every calendar and sends what changed to the subscribers. Calendars
+// that fail to sync keep their previous events and are retried on the next
+// refresh. Events stay readable while syncing.
+func (c *CalendarMonitor) Refresh(ctx context.Context) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	calendars, err := c.fetchCalendars(ctx)
+	if err != nil {
+		return fmt.Errorf("error while fetching calendars: %v", err)
+	}
+
+	c.mu.Lock()
+	prevSyncs := maps.Clone(c.syncs)
+	c.mu.Unlock()
+
+	now := time.Now()
+	syncs := make(map[string]*calendarSyncState, len(calendars))
+	changes := make([]CalendarChange, 0)
+	dirty := false
+	var errs error
+
+	// Calendars the user no longer has selected are forgotten without reporting
+	// their events as deleted
+	for id := range prevSyncs {
+		if _, ok := calendars[id]; !ok {
+			dirty = true
+		}
+	}
+
+	for _, cal := range calendars {
+		prev := prevSyncs[cal.Id]
+
+		s, calChanges, err := c.syncCalendar(ctx, now, cal, prev)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("error while syncing calendar %s: %v", cal.Id, err))
+
+			if prev != nil {
+				syncs[cal.Id] = prev
+			}
+
+			continue
+		}
+
+		syncs[cal.Id] = s
+		changes = append(changes, calChanges...)
+		dirty = dirty || prev == nil || len(calChanges) > 0 || s.SyncToken != prev.SyncToken || len(s.Events) != len(prev.Events)
+	}
+
+	c.mu.Lock()
+	c.calendars = calendars
+	c.syncs = syncs
+
+	if dirty {
+		c.saveState()
+	}
+	c.mu.Unlock()
+
+	if len(changes) > 0 {
+		slog.Info("calendar events changed", "numChanges", len(changes))
+		c.subs.send(changes)
+	}
+
+	return errs
+}
+
+// Registers a new subscriber for the changes found by every following refresh.
+func (c *CalendarMonitor) Subscribe() *CalendarSubscription {
+	return c.subs.add()
+}
+
+// Stops sending changes to sub and closes its channel.
+func (c *CalendarMonitor) Unsubscribe(sub *CalendarSubscription) {
+	c.subs.remove(sub)
+}
+
+// Upcoming and ongoing events as of the last refresh within the lookahead,
+// ordered by start time.
+func (c *CalendarMonitor) Events() []*CalendarEvent {
+	now := time.Now()
+	return c.EventsBetween(now, now.Add(c.opts.Lookahead))
+}
+
+// Events as of the last refresh that overlap the time between from and until,
+// ordered by start time. Only events up to a day past the lookahead are known.
+func (c *CalendarMonitor) EventsBetween(from time.Time, until time.Time) []*CalendarEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	events := make([]*CalendarEvent, 0)
+	for _, s := range c.syncs {
+		for _, ev := range s.Events {
+			if ev.End.After(from) && ev.Start.Before(until) {
+				events = append(events, ev)
+			}
+		}
+	}
+
+	slices.SortFunc(events, func(a, b *CalendarEvent) int { return a.Start.Compare(b.Start) })
+
+	return events
+}
+
+// Returns the event with the id from the calendar, or nil.
+func (c *CalendarMonitor) Event(calendarId string, eventId string) *CalendarEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.syncs[calendarId]
+	if !ok {
+		return nil
+	}
+
+	return s.Events[eventId]
+}
+
+// Upcoming and ongoing events the user is invited to and has not responded to
+// yet, ordered by start time. Unlike Events, includes the events up to a day
+// past the lookahead.
+func (c *CalendarMonitor) Invitations() []*CalendarEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	events := make([]*CalendarEvent, 0)
+	for _, s := range c.syncs {
+		for _, ev := range s.Events {
+			if ev.ResponseStatus == "needsAction" && ev.Status != "cancelled" && ev.End.After(now) {
+				events = append(events, ev)
+			}
+		}
+	}
+
+	slices.SortFunc(events, func(a, b *CalendarEvent) int { return a.Start.Compare(b.Start) })
+
+	return events
+}
+
+// Sets the response of the user to an event they are invited to, one of
+// "accepted", "declined" or "tentative". Responding to a recurring event
+// responds to all of its instances. The local events are updated by the next
+// refresh.
+func (c *CalendarMonitor) Respond(ctx context.Context, calendarId string, eventId string, responseStatus string) error {
+	e, err := c.svc.Events.Get(calendarId, eventId).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error while fetching event %s: %v", eventId, err)
+	}
+
+	found := false
+	for _, a := range e.Attendees {
+		if a.Self {
+			a.ResponseStatus = responseStatus
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("user is not an attendee of event %s", eventId)
+	}
+
+	// Patching replaces the whole list of attendees
+	// Lets the organizer know, like responding in the Calendar web client does
+	_, err = c.svc.Events.Patch(calendarId, eventId, &calendar.Event{Attendees: e.Attendees}).
+		SendUpdates("all").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return fmt.Errorf("error while updating response to event %s: %v", eventId, err)
+	}
+
+	return nil
+}
+
+func (c *CalendarMonitor) fetchCalendars(ctx context.Context) (map[string]*Calendar, error) {
+	calendars := make(map[string]*Calendar)
+
+	err := c.svc.CalendarList.List().Pages(ctx, func(res *calendar.CalendarList) error {
+		for _, entry := range res.Items {
+			if entry.Selected && !entry.Hidden && !entry.Deleted {
+				calendars[entry.Id] = newCalendar(entry)
+			}
+		}
+
+		return nil
+	})
+
+	return calendars, err
+}
+
+// Returns the new sync state of the calendar, which prev is left untouched by.
+// Runs an incremental sync if possible, or a full sync if the calendar was
+// never synced, its sync token expired or the lookahead reached past the
+// synced window. Ended events are dropped.
+func (c *CalendarMonitor) syncCalendar(ctx context.Context, now time.Time, cal *Calendar, prev *calendarSyncState) (*calendarSyncState, []CalendarChange, error) {
+	if prev == nil {
+		prev = &calendarSyncState{Events: make(map[string]*CalendarEvent)}
+	}
+
+	if prev.SyncToken != "" && !now.Add(c.opts.Lookahead).After(prev.WindowEnd) {
+		s, changes, err := c.incrementalSync(ctx, now, cal, prev)
+
+		// 410 when the sync token is no longer valid
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusGone {
+			slog.Info("calendar sync token expired, running a full sync", "calendarId", cal.Id)
+		} else {
+			return s, changes, err
+		}
+	}
+
+	return c.fullSync(ctx, now, cal, prev)
+}
+
+func (c *CalendarMonitor) incrementalSync(ctx context.Context, now time.Time, cal *Calendar, prev *calendarSyncState) (*calendarSyncState, []CalendarChange, error) {
+	updated := make([]*CalendarEvent, 0)
+
+	nextSyncToken, err := c.listEvents(ctx, cal, prev.SyncToken, time.Time{}, time.Time{}, &updated)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &calendarSyncState{
+		SyncToken: nextSyncToken,
+		WindowEnd: prev.WindowEnd,
+		Events:    maps.Clone(prev.Events),
+	}
+
+	changes := make([]CalendarChange, 0, len(updated))
+	for _, ev := range updated {
+		old := s.Events[ev.Id]
+
+		// Changes are reported for all events, but only the ones within the synced
+		// window are kept. The others are picked up by the next full sync.
+		inWindow := ev.Start.Before(s.WindowEnd) && ev.End.After(now)
+
+		switch {
+		case old == nil && (ev.Status == "cancelled" || !inWindow):
+			// Deleted before we ever saw it, or too far ahead to matter yet
+			continue
+
+		case ev.Status == "cancelled":
+			// Deleted events only carry their id and status
+			deleted := *old
+			deleted.Status = ev.Status
+			changes = append(changes, CalendarChange{Type: CalendarChangeType_Deleted, Event: &deleted, Previous: old})
+			delete(s.Events, ev.Id)
+
+		case old == nil:
+			changes = append(changes, CalendarChange{Type: CalendarChangeType_Added, Event: ev})
+			s.Events[ev.Id] = ev
+
+		default:
+			changes = append(changes, CalendarChange{Type: CalendarChangeType_Changed, Event: ev, Previous: old})
+
+			if inWindow {
+				s.Events[ev.Id] = ev
+			} else {
+				delete(s.Events, ev.Id)
+			}
+		}
+	}
+
+	pruneEnded(now, s.Events)
+
+	return s, changes, nil
+}
+
+// Fetches the events from now until a day past the lookahead, reporting the
+// difference to the previously known events as changes. Recurring events are
+// expanded into their instances, so the window keeps the number of events
+// bounded.
+func (c *CalendarMonitor) fullSync(ctx context.Context, now time.Time, cal *Calendar, prev *calendarSyncState) (*calendarSyncState, []CalendarChange, error) {
+	windowEnd := now.Add(c.opts.Lookahead + calendarWindowSlack)
+	fetched := make([]*CalendarEvent, 0)
+
+	nextSyncToken, err := c.listEvents(ctx, cal, "", now, windowEnd, &fetched)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &calendarSyncState{
+		SyncToken: nextSyncToken,
+		WindowEnd: windowEnd,
+		Events:    make(map[string]*CalendarEvent, len(fetched)),
+	}
+
+	for _, ev := range fetched {
+		if ev.Status != "cancelled" {
+			s.Events[ev.Id] = ev
+		}
+	}
+
+	changes := make([]CalendarChange, 0)
+	for id, ev := range s.Events {
+		old, ok := prev.Events[id]
+		switch {
+		case !ok:
+			changes = append(changes, CalendarChange{Type: CalendarChangeType_Added, Event: ev})
+		case !ev.Updated.Equal(old.Updated):
+			changes = append(changes, CalendarChange{Type: CalendarChangeType_Changed, Event: ev, Previous: old})
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(prev.Events)) {
+		old := prev.Events[id]
+
+		// Events that ended were simply dropped
+		if _, ok := s.Events[id]; !ok && old.End.After(now) {
+			deleted := *old
+			deleted.Status = "cancelled"
+			changes = append(changes, CalendarChange{Type: CalendarChangeType_Deleted, Event: &deleted, Previous: old})
+		}
+	}
+
+	return s, changes, nil
+}
+
+// Lists the events of the calendar into events. A full listing of the events
+// between timeMin and timeMax if syncToken is empty, otherwise only what
+// changed since the token was issued. Returns the token for the next
+// incremental sync.
+func (c *CalendarMonitor) listEvents(ctx context.Context, cal *Calendar, syncToken string, timeMin time.Time, timeMax time.Time, events *[]*CalendarEvent) (string, error) {
+	var nextSyncToken string
+
+	forEachPage := func(res *calendar.Events) error {
+		for _, e := range res.Items {
+			// Deleted events have no start or end, so they can't be parsed
+			if e.Status == "cancelled" {
+				*events = append(*events, &CalendarEvent{Id: e.Id, CalendarId: cal.Id, Status: e.Status})
+				continue
+			}
+
+			ev, err := newCalendarEvent(cal, e)
+			if err != nil {
+				slog.Warn("skipping invalid calendar event", "calendarId", cal.Id, "error", err)
+				continue
+			}
+
+			*events = append(*events, ev)
+		}
+
+		// Only set on the last page
+		if res.NextSyncToken != "" {
+			nextSyncToken = res.NextSyncToken
+		}
+
+		return nil
+	}
+
+	// Recurring events are expanded into their instances, each with its own
+	// start time
+	call := c.svc.Events.List(cal.Id).
+		SingleEvents(true).
+		ShowDeleted(syncToken != "")
+
+	// Incremental syncs must not set any time bounds, they report changes to
+	// events anywhere in time
+	if syncToken != "" {
+		call = call.SyncToken(syncToken)
+	} else {
+		call = call.TimeMin(timeMin.Format(time.RFC3339)).TimeMax(timeMax.Format(time.RFC3339))
+	}
+
+	err := call.Pages(ctx, forEachPage)
+
+	return nextSyncToken, err
+}
+
+// Drops events that are over, they can't change anything anymore.
+func pruneEnded(now time.Time, events map[string]*CalendarEvent) {
+	maps.DeleteFunc(events, func(_ string, ev *CalendarEvent) bool {
+		return !ev.End.After(now)
+	})
+}
+
+// Must be called with c.mu held.
+func (c *CalendarMonitor) saveState() {
+	if c.opts.State == nil {
+		return
+	}
+
+	s := calendarMonitorState{Calendars: c.syncs}
+	if err := c.opts.State.Save(c.opts.StateKey, &s); err != nil {
+		// Not fatal, at worst the next start runs a full sync
+		slog.Error("failed to save calendar sync state", "key", c.opts.StateKey, "error", err)
+	}
+}
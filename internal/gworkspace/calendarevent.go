@@ -0,0 +1,177 @@
+package gworkspace
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/joinlink"
+	"google.golang.org/api/calendar/v3"
+)
+
+type Calendar struct {
+	Id      string
+	Summary string
+	// Timezone all-day events of the calendar start and end in
+	Location *time.Location
+	// Popup reminders applied to timed events that use the calendar's defaults
+	DefaultReminders []time.Duration
+}
+
+func newCalendar(entry *calendar.CalendarListEntry) *Calendar {
+	loc, err := time.LoadLocation(entry.TimeZone)
+	if err != nil || entry.TimeZone == "" {
+		loc = time.Local
+	}
+
+	return &Calendar{
+		Id:               entry.Id,
+		Summary:          entry.Summary,
+		Location:         loc,
+		DefaultReminders: popupReminders(entry.DefaultReminders),
+	}
+}
+
+type CalendarEvent struct {
+	Id         string
+	CalendarId string
+	// Id of the recurring event this is an instance of, empty for single events
+	RecurringEventId string
+	// Identifies the event across calendars and in invitation emails, shared by
+	// all instances of a recurring event
+	ICalUID string
+
+	Summary     string
+	Description string
+	Location    string
+	// Link to the event in the Calendar web client
+	HtmlLink string
+	// Link to join the video meeting of the event, if it has one
+	VideoLink string
+	// One of "confirmed", "tentative" or "cancelled"
+	Status string
+
+	Start time.Time
+	// Exclusive
+	End time.Time
+	// All-day events start and end at midnight in the calendar's timezone
+	AllDay bool
+
+	// Popup reminders, as the time before Start they are due
+	Reminders []time.Duration
+
+	// Response of the user if they are an attendee, such as "accepted" or
+	// "declined". Empty if they are not invited, such as on their own events.
+	ResponseStatus string
+	// Name of the organizer, or their address if they have no name
+	Organizer      string
+	OrganizerEmail string
+	// Whether the user organizes the event, so changes to it are theirs
+	OrganizedBySelf bool
+
+	Updated time.Time
+}
+
+func newCalendarEvent(cal *Calendar, e *calendar.Event) (*CalendarEvent, error) {
+	ev := &CalendarEvent{
+		Id:               e.Id,
+		CalendarId:       cal.Id,
+		RecurringEventId: e.RecurringEventId,
+		ICalUID:          e.ICalUID,
+		Summary:          e.Summary,
+		Description:      e.Description,
+		Location:         e.Location,
+		HtmlLink:         e.HtmlLink,
+		VideoLink:        videoLink(e),
+		Status:           e.Status,
+	}
+
+	var err error
+
+	if e.Start == nil || e.End == nil {
+		return nil, fmt.Errorf("event %s has no start or end", e.Id)
+	}
+
+	if e.Start.Date != "" {
+		ev.AllDay = true
+
+		if ev.Start, err = time.ParseInLocation(time.DateOnly, e.Start.Date, cal.Location); err != nil {
+			return nil, fmt.Errorf("invalid start date of event %s: %v", e.Id, err)
+		}
+
+		if ev.End, err = time.ParseInLocation(time.DateOnly, e.End.Date, cal.Location); err != nil {
+			return nil, fmt.Errorf("invalid end date of event %s: %v", e.Id, err)
+		}
+	} else {
+		if ev.Start, err = time.Parse(time.RFC3339, e.Start.DateTime); err != nil {
+			return nil, fmt.Errorf("invalid start time of event %s: %v", e.Id, err)
+		}
+
+		if ev.End, err = time.Parse(time.RFC3339, e.End.DateTime); err != nil {
+			return nil, fmt.Errorf("invalid end time of event %s: %v", e.Id, err)
+		}
+	}
+
+	switch {
+	case e.Reminders != nil && !e.Reminders.UseDefault:
+		ev.Reminders = popupReminders(e.Reminders.Overrides)
+	case !ev.AllDay:
+		ev.Reminders = slices.Clone(cal.DefaultReminders)
+	default:
+		// The defaults the api reports only apply to timed events, the defaults for
+		// all-day events are not available
+	}
+
+	for _, a := range e.Attendees {
+		if a.Self {
+			ev.ResponseStatus = a.ResponseStatus
+		}
+	}
+
+	if e.Organizer != nil {
+		ev.Organizer = cmp.Or(e.Organizer.DisplayName, e.Organizer.Email)
+		ev.OrganizerEmail = e.Organizer.Email
+		ev.OrganizedBySelf = e.Organizer.Self
+	}
+
+	if e.Updated != "" {
+		ev.Updated, _ = time.Parse(time.RFC3339, e.Updated)
+	}
+
+	return ev, nil
+}
+
+func popupReminders(reminders []*calendar.EventReminder) []time.Duration {
+	durations := make([]time.Duration, 0, len(reminders))
+	for _, r := range reminders {
+		if r.Method == "popup" {
+			durations = append(durations, time.Duration(r.Minutes)*time.Minute)
+		}
+	}
+
+	return durations
+}
+
+// The Meet link of the event, or the video entry point of its conference, such
+// as a Zoom meeting added through an add-on. Falls back to a Zoom, Teams or
+// Webex link pasted into the location or description.
+func videoLink(e *calendar.Event) string {
+	if e.HangoutLink != "" {
+		return e.HangoutLink
+	}
+
+	if e.ConferenceData != nil {
+		for _, ep := range e.ConferenceData.EntryPoints {
+			if ep.EntryPointType == "video" {
+				return ep.Uri
+			}
+		}
+	}
+
+	if link, ok := joinlink.Find(e.Location, e.Description); ok {
+		return link.Url
+	}
+
+	return ""
+}
@@ -0,0 +1,88 @@
+package gworkspace
+
+import (
+	"slices"
+	"sync"
+)
+
+const (
+	defaultCalendarSubscriptionBufferSize = 8
+)
+
+type CalendarSubscription struct {
+	changes chan []CalendarChange
+}
+
+// Receives the changes found by each refresh until the subscription is removed
+// with Unsubscribe, which closes the channel. Changes of a subscriber that is
+// not keeping up are combined, so nothing is lost.
+func (s *CalendarSubscription) Changes() <-chan []CalendarChange {
+	return s.changes
+}
+
+// Subscribers of a CalendarMonitor
+type calendarSubscribers struct {
+	mu   sync.RWMutex
+	subs []*CalendarSubscription
+}
+
+func (s *calendarSubscribers) add() *CalendarSubscription {
+	sub := &CalendarSubscription{
+		changes: make(chan []CalendarChange, defaultCalendarSubscriptionBufferSize),
+	}
+
+	s.mu.Lock()
+	s.subs = append(s.subs, sub)
+	s.mu.Unlock()
+
+	return sub
+}
+
+func (s *calendarSubscribers) remove(sub *CalendarSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.Index(s.subs, sub)
+	if i == -1 {
+		return
+	}
+
+	s.subs = slices.Delete(s.subs, i, i+1)
+	close(sub.changes)
+}
+
+// Sends changes to every subscriber. Subscribers must not modify them.
+func (s *calendarSubscribers) send(changes []CalendarChange) {
+	// Held for reading so that Unsubscribe can't close a channel that is being
+	// sent to
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, sub := range s.subs {
+		sub.send(changes)
+	}
+}
+
+func (sub *CalendarSubscription) send(changes []CalendarChange) {
+	select {
+	case sub.changes <- changes:
+		return
+	default:
+	}
+
+	merged := make([]CalendarChange, 0)
+
+drain:
+	for {
+		select {
+		case buffered := <-sub.changes:
+			merged = append(merged, buffered...)
+		default:
+			break drain
+		}
+	}
+
+	// Refreshes are serialized, so this is the only sender and the buffer that
+	// was just emptied has room
+	sub.changes <- append(merged, changes...)
+}
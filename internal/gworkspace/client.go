@@ -2,127 +2,204 @@ package gworkspace
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/gmail/v1"
 )
 
 const (
 	credentialsFilePath = "credentials.json"
-	tokenFilePath       = "token.json"
 )
 
+// Credentials of an account as written in the config.
+type AccountCredentials struct {
+	TokenType    string
+	AccessToken  string
+	RefreshToken string
+	Expiry       string
+	ExpiresIn    int
+}
+
+// Builds an oauth token from the account credentials. Returns nil if the account
+// has no credentials configured.
+func (c AccountCredentials) Token() (*oauth2.Token, error) {
+	if c.AccessToken == "" && c.RefreshToken == "" {
+		return nil, nil
+	}
+
+	tok := &oauth2.Token{
+		TokenType:    c.TokenType,
+		AccessToken:  c.AccessToken,
+		RefreshToken: c.RefreshToken,
+		ExpiresIn:    int64(c.ExpiresIn),
+	}
+
+	if c.Expiry != "" {
+		expiry, err := time.Parse(time.RFC3339, c.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse token expiry (%s): %v", c.Expiry, err)
+		}
+
+		tok.Expiry = expiry
+	}
+
+	return tok, nil
+}
+
+// Authorized client for the apis of a single account. Shared by every service
+// that works with the account, so that the user is only asked to authorize it
+// once.
 type HttpClient struct {
 	*http.Client
+
+	mu         sync.Mutex
+	configured bool
+
+	accountName string
+	token       *oauth2.Token
+	store       TokenStore
+	authFlow    AuthFlow
+	breaker     *CircuitBreaker
 }
 
-func NewHttpClient() *HttpClient {
+// Creates a client for the named account. The token saved in store takes
+// precedence over token, which is only used to seed an empty store. If neither
+// holds a usable token, a new one is requested using authFlow during Configure.
+// Every token obtained or refreshed afterwards is saved back to store.
+func NewHttpClient(accountName string, token *oauth2.Token, store TokenStore, authFlow AuthFlow) *HttpClient {
 	return &HttpClient{
-		Client: &http.Client{},
+		Client:      &http.Client{},
+		accountName: accountName,
+		token:       token,
+		store:       store,
+		authFlow:    authFlow,
+		breaker:     NewCircuitBreaker(accountName),
 	}
 }
 
+// Breaker that trips when requests made by the client keep failing.
+func (c *HttpClient) CircuitBreaker() *CircuitBreaker {
+	return c.breaker
+}
+
+// Authorizes the client for scopes. If the stored token was not granted all of
+// scopes, the user is asked to consent to only the missing ones. Once
+// successful, further calls do nothing, so every service sharing the client can
+// call it before use.
 func (c *HttpClient) Configure(ctx context.Context, scopes ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.configured {
+		return nil
+	}
+
 	b, err := os.ReadFile(credentialsFilePath)
 	if err != nil {
 		return fmt.Errorf("error while reading credentials files (%s): %v", credentialsFilePath, err)
 	}
 
-	cfg, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	cfg, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		return fmt.Errorf("error while configuring oauth: %v", err)
 	}
 
-	tok, err := getToken(ctx, cfg)
+	tok, err := c.getToken(ctx, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to get oauth token: %v", err)
 	}
 
-	c.Client = cfg.Client(ctx, tok)
-
-	return nil
-}
-
-func getToken(ctx context.Context, cfg *oauth2.Config) (*oauth2.Token, error) {
-	tok, err := getCachedToken()
-	if err != nil {
-		slog.Warn("failed to get cached token", "file", tokenFilePath, "error", err)
-
-		tok, err = getTokenFromWeb(ctx, cfg)
+	if len(tok.Scopes) == 0 {
+		granted, err := lookupGrantedScopes(ctx, cfg.TokenSource(ctx, &tok.Token))
 		if err != nil {
-			return nil, fmt.Errorf("failed to get token new token: %v", err)
+			// Without knowing the granted scopes we can't tell if consent is needed,
+			// so assume the token is sufficient and let the API calls fail otherwise
+			slog.Warn("failed to look up scopes granted to token", "account", c.accountName, "error", err)
+		} else {
+			tok.Scopes = granted
+			c.saveToken(tok)
 		}
+	}
+
+	if missing := missingScopes(tok.Scopes, scopes); len(tok.Scopes) > 0 && len(missing) > 0 {
+		slog.Info("token is missing scopes, requesting additional consent", "account", c.accountName, "missingScopes", missing)
 
-		err = setCachedToken(tok)
+		tok, err = c.requestAdditionalScopes(ctx, cfg, tok, missing)
 		if err != nil {
-			// This error is okay because we will just get a new token next time
-			slog.Error("failed to set cached token", "error", err)
+			return fmt.Errorf("failed to get consent for additional scopes: %v", err)
 		}
-	}
-	return tok, nil
-}
-
-func getCachedToken() (*oauth2.Token, error) {
-	slog.Debug("getting cached token from file", "file", tokenFilePath)
 
-	f, err := os.Open(tokenFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open token file (%s): %v", tokenFilePath, err)
+		c.saveToken(tok)
 	}
-	defer f.Close()
 
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
+	// Token refreshes must outlive the service that happened to configure the
+	// client first
+	refreshCtx := context.WithoutCancel(ctx)
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse token file (%s): %v", tokenFilePath, err)
+	src := newStoringTokenSource(cfg.TokenSource(refreshCtx, &tok.Token), c.store, tok)
+	c.Client = &http.Client{
+		Transport: NewRetryTransport(oauth2.NewClient(refreshCtx, src).Transport, c.breaker),
 	}
+	c.configured = true
 
-	return tok, nil
+	return nil
 }
 
-func setCachedToken(token *oauth2.Token) error {
-	slog.Debug("caching token in file", "file", tokenFilePath)
-
-	f, err := os.OpenFile(tokenFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("failed to open token file (%s): %v", tokenFilePath, err)
+func (c *HttpClient) getToken(ctx context.Context, cfg *oauth2.Config) (*StoredToken, error) {
+	tok, err := c.store.Load()
+	if err == nil {
+		return tok, nil
 	}
-	defer f.Close()
 
-	err = json.NewEncoder(f).Encode(token)
-	if err != nil {
-		return fmt.Errorf("failed to write token file (%s): %v", tokenFilePath, err)
+	if !errors.Is(err, ErrTokenNotFound) {
+		slog.Warn("failed to load stored token", "account", c.accountName, "error", err)
 	}
 
-	return nil
-}
+	if isUsableToken(c.token) {
+		tok = &StoredToken{Token: *c.token}
+	} else {
+		newTok, err := c.authFlow.Token(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get new token: %v", err)
+		}
 
-func getTokenFromWeb(ctx context.Context, cfg *oauth2.Config) (*oauth2.Token, error) {
-	slog.Info("getting new token from the web")
+		tok = &StoredToken{Token: *newTok, Scopes: grantedScopes(newTok, cfg.Scopes)}
+	}
 
-	stateToken := "state-token" // TODO: Generate proper state token
-	authUrl := cfg.AuthCodeURL(stateToken, oauth2.AccessTypeOffline)
+	c.saveToken(tok)
 
-	// TODO: Automatically open browser or web view
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authUrl)
+	return tok, nil
+}
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		return nil, fmt.Errorf("failed to read auth code: %v", err)
-	}
+// Runs the auth flow for only the missing scopes. Google merges the previously
+// granted scopes into the new token.
+// See https://developers.google.com/identity/protocols/oauth2/web-server#incrementalAuth
+func (c *HttpClient) requestAdditionalScopes(ctx context.Context, cfg *oauth2.Config, tok *StoredToken, missing []string) (*StoredToken, error) {
+	incrementalCfg := *cfg
+	incrementalCfg.Scopes = missing
 
-	tok, err := cfg.Exchange(ctx, authCode)
+	newTok, err := c.authFlow.Token(ctx, &incrementalCfg, oauth2.SetAuthURLParam("include_granted_scopes", "true"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to exchange for auth token: %v", err)
+		return nil, err
 	}
 
-	return tok, nil
+	return &StoredToken{Token: *newTok, Scopes: grantedScopes(newTok, unionScopes(tok.Scopes, missing))}, nil
+}
+
+func (c *HttpClient) saveToken(tok *StoredToken) {
+	if err := c.store.Save(tok); err != nil {
+		// This error is okay because we will just get a new token next time
+		slog.Error("failed to save token", "account", c.accountName, "error", err)
+	}
+}
+
+func isUsableToken(tok *oauth2.Token) bool {
+	return tok != nil && (tok.AccessToken != "" || tok.RefreshToken != "")
 }
@@ -0,0 +1,53 @@
+package gworkspace
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/oauth2"
+)
+
+// Called with the code the user must enter at verificationUrl to authorize the
+// application.
+type DevicePromptFunc func(userCode, verificationUrl string)
+
+// OAuth 2.0 device authorization grant for machines without a browser.
+// See https://developers.google.com/identity/protocols/oauth2/limited-input-device
+type deviceFlow struct {
+	prompt DevicePromptFunc
+}
+
+func newDeviceFlow(prompt DevicePromptFunc) *deviceFlow {
+	return &deviceFlow{
+		prompt: prompt,
+	}
+}
+
+func (f *deviceFlow) Token(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	opts = append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, opts...)
+
+	res, err := cfg.DeviceAuth(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request device code: %v", err)
+	}
+
+	verificationUrl := res.VerificationURIComplete
+	if verificationUrl == "" {
+		verificationUrl = res.VerificationURI
+	}
+
+	slog.Info("waiting for oauth authorization on another device", "userCode", res.UserCode, "url", verificationUrl, "expiry", res.Expiry)
+	if f.prompt != nil {
+		f.prompt(res.UserCode, verificationUrl)
+	}
+
+	// Polls the token endpoint at the interval requested by the server until the
+	// user approves, denies or the device code expires
+	tok, err := cfg.DeviceAccessToken(ctx, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token from device authorization: %v", err)
+	}
+
+	return tok, nil
+}
@@ -2,13 +2,16 @@ package gworkspace
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
 	"slices"
 	"sync"
 	"time"
 
+	"github.com/link00000000/gwsn/internal/state"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/googleapi"
@@ -54,32 +57,97 @@ func (h *GmailHistoryId) Clear() {
 	h.isValid = false
 }
 
-type GmailMessage struct {
-	To      string
-	From    string
-	Subject string
+type GmailMonitorOptions struct {
+	UpdateFreq time.Duration
+
+	// Persists the last processed history id under StateKey so that messages
+	// received while the app was not running are reported on the next start.
+	// May be nil.
+	State    state.Store
+	StateKey string
+
+	// Which messages to report. Defaults to messages in the inbox.
+	Labels GmailLabelFilter
+
+	// Maximum number of messages reported by a single check. When exceeded, only
+	// the newest messages are reported. 0 for no limit.
+	MaxMessagesPerCheck int
+
+	// Authorized client used to send batch requests, since the gmail service
+	// does not expose its own. If nil, message metadata is fetched with one
+	// request per message.
+	HttpClient *http.Client
+	// Number of messages fetched in a single batch request, at most 100
+	BatchSize int
+	// Maximum number of requests in flight while fetching messages
+	MaxConcurrentRequests int
+}
+
+const (
+	defaultMaxConcurrentRequests = 16
+
+	// Number of recently reported message ids remembered to avoid reporting a
+	// message twice when reconciling after the history id expires
+	maxRecentMessageIds = 512
+	// Number of messages that could not be fetched remembered to be retried by
+	// the next check
+	maxPendingMessageIds = 512
+)
+
+// Persisted between runs in GmailMonitorOptions.State
+type gmailMonitorState struct {
+	HistoryId uint64 `json:"historyId"`
+
+	// Unix milliseconds
+	LastInternalDate int64 `json:"lastInternalDate,omitempty"`
+	LastCheck        int64 `json:"lastCheck,omitempty"`
+
+	RecentMessageIds  []string `json:"recentMessageIds,omitempty"`
+	PendingMessageIds []string `json:"pendingMessageIds,omitempty"`
 }
 
 type GmailMonitor struct {
-	mu  sync.Mutex
-	svc *gmail.Service
+	mu sync.Mutex
+	// Held while checking and sending, so that subscribers receive events in
+	// order without mu being held while sending
+	checkMu sync.Mutex
+
+	svc  *gmail.Service
+	opts GmailMonitorOptions
+
+	batch *gmailBatchClient
+	// Labels of the mailbox as of Initialize
+	mailboxLabels *GmailLabels
+	labels        *gmailLabelIdFilter
 
 	isInitialized bool
 	historyId     *GmailHistoryId
-	updateFreq    time.Duration
 
-	msgsChan chan []*GmailMessage
+	// Newest internal date of all reported messages
+	lastInternalDate time.Time
+	// Start of the last successful check
+	lastCheck time.Time
+	// Ids of the most recently reported messages, oldest first
+	recentMessageIds []string
+	// Ids of new messages that could not be fetched, retried by the next check
+	pendingMessageIds []string
+
+	subs gmailSubscribers
 }
 
-func NewGmailMonitor(svc *gmail.Service, updateFreq time.Duration) *GmailMonitor {
+func NewGmailMonitor(svc *gmail.Service, opts GmailMonitorOptions) *GmailMonitor {
+	var batch *gmailBatchClient
+	if opts.HttpClient != nil {
+		batch = newGmailBatchClient(opts.HttpClient, svc.BasePath)
+	}
+
 	return &GmailMonitor{
-		svc: svc,
+		svc:   svc,
+		opts:  opts,
+		batch: batch,
 
 		isInitialized: false,
 		historyId:     NewGmailHistoryId(),
-		updateFreq:    updateFreq,
-
-		msgsChan: make(chan []*GmailMessage, 32),
 	}
 }
 
@@ -87,9 +155,30 @@ func (g *GmailMonitor) Initialize(ctx context.Context) error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	err := g.refreshHistoryId(ctx)
+	restored, err := g.restoreState()
+	if err != nil {
+		slog.Warn("failed to restore gmail monitor state, starting from the latest history id", "key", g.opts.StateKey, "error", err)
+	}
+
+	if !restored {
+		g.lastCheck = time.Now()
+
+		err := g.refreshHistoryId(ctx)
+		if err != nil {
+			return fmt.Errorf("error while fetching latest history id: %v", err)
+		}
+
+		g.saveState()
+	}
+
+	g.mailboxLabels, err = listGmailLabels(ctx, g.svc)
 	if err != nil {
-		return fmt.Errorf("error while fetching latest history id: %v", err)
+		return err
+	}
+
+	g.labels, err = resolveGmailLabelFilter(g.mailboxLabels, g.opts.Labels)
+	if err != nil {
+		return fmt.Errorf("error while resolving label filter: %v", err)
 	}
 
 	g.isInitialized = true
@@ -97,8 +186,18 @@ func (g *GmailMonitor) Initialize(ctx context.Context) error {
 	return nil
 }
 
+// Returns the labels of the mailbox, for resolving label names the way the
+// label filter does. Only valid after Initialize.
+func (g *GmailMonitor) Labels() *GmailLabels {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.mailboxLabels
+}
+
 func (g *GmailMonitor) Watch(ctx context.Context) error {
-	ticker := time.NewTicker(g.updateFreq)
+	ticker := time.NewTicker(g.opts.UpdateFreq)
+	defer ticker.Stop()
 
 	tick := func() {
 		slog.Debug("GmailMonitor Watch checking for new messages")
@@ -108,7 +207,7 @@ func (g *GmailMonitor) Watch(ctx context.Context) error {
 			slog.Error("error while checking for new messages", "error", err)
 		}
 
-		slog.Debug("GmailMonitor Watch waiting before checking again", "duration", g.updateFreq)
+		slog.Debug("GmailMonitor Watch waiting before checking again", "duration", g.opts.UpdateFreq)
 	}
 
 	slog.Debug("starting GmailMonitor ticker")
@@ -126,53 +225,104 @@ func (g *GmailMonitor) Watch(ctx context.Context) error {
 	}
 }
 
+// Checks for changes and sends them to every subscriber.
 func (g *GmailMonitor) CheckNow(ctx context.Context) error {
+	g.checkMu.Lock()
+	defer g.checkMu.Unlock()
+
+	ev, err := g.check(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ev != nil {
+		g.subs.send(ev)
+	}
+
+	return nil
+}
+
+// Registers a new subscriber for the changes found by every following check.
+func (g *GmailMonitor) Subscribe(opts GmailSubscribeOptions) *GmailSubscription {
+	return g.subs.add(opts)
+}
+
+// Stops sending events to sub and closes its channel.
+func (g *GmailMonitor) Unsubscribe(sub *GmailSubscription) {
+	g.subs.remove(sub)
+}
+
+// Returns nil if nothing changed.
+func (g *GmailMonitor) check(ctx context.Context) (*GmailEvent, error) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
 	slog.Debug("checking for new messages")
 
-	msgs, err := g.fetchNewMessages(ctx)
+	checkStart := time.Now()
 
-	// 404 when history id is invalid
-	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
-		slog.Debug("gmail responded 404 when fetching new messages. refreshing history id and trying again")
+	msgs, removed, err := g.fetchNewMessages(ctx)
 
-		err := g.refreshHistoryId(ctx)
-		if err != nil {
-			return fmt.Errorf("error while refreshing history id: %v", err)
-		}
-
-		msgs, err = g.fetchNewMessages(ctx)
+	// 404 when history id is invalid
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusNotFound {
+		slog.Info("gmail history id expired, reconciling from the message list")
+
+		// Removals since the history id expired are lost, the notifications of
+		// those messages stay until they are closed by hand
+		removed = nil
+		msgs, err = g.reconcileMessages(ctx)
 		if err != nil {
-			return fmt.Errorf("error while fetching new messages: %v", err)
+			return nil, fmt.Errorf("error while reconciling messages after history id expired: %v", err)
 		}
 	}
 
 	if err != nil {
-		return fmt.Errorf("error while fetching new messages: %v", err)
+		return nil, fmt.Errorf("error while fetching new messages: %v", err)
+	}
+
+	// Messages that were already read or deleted by the time we saw them are
+	// not worth reporting
+	msgs = slices.DeleteFunc(msgs, func(msg *GmailMessage) bool {
+		return slices.Contains(g.recentMessageIds, msg.Id) || slices.Contains(removed, msg.Id)
+	})
+
+	// Only messages that were reported can have anything to take back
+	removed = slices.DeleteFunc(removed, func(id string) bool {
+		return !slices.Contains(g.recentMessageIds, id)
+	})
+
+	g.recordReported(msgs)
+	g.lastCheck = checkStart
+
+	if max := g.opts.MaxMessagesPerCheck; max > 0 && len(msgs) > max {
+		slog.Info("too many new messages from gmail, only reporting the newest", "numMessages", len(msgs), "max", max)
+		msgs = msgs[len(msgs)-max:]
+	}
+
+	g.saveState()
+
+	if len(msgs) == 0 && len(removed) == 0 {
+		return nil, nil
 	}
 
 	if len(msgs) > 0 {
 		slog.Info("received new messages from gmail", "numMessages", len(msgs))
 		for _, msg := range msgs {
-			slog.Debug("new messages", "to", msg.To, "from", msg.From, "subject", msg.Subject)
-		}
-
-		select {
-		case g.msgsChan <- msgs:
-		case <-ctx.Done():
+			slog.Debug("new messages", "id", msg.Id, "threadId", msg.ThreadId, "from", msg.Sender(), "subject", msg.Subject)
 		}
 	}
 
-	return nil
-}
+	if len(removed) > 0 {
+		slog.Info("reported gmail messages were read, archived or deleted", "numMessages", len(removed))
+	}
 
-func (g *GmailMonitor) Messages() <-chan []*GmailMessage {
-	return g.msgsChan
+	return &GmailEvent{Messages: msgs, RemovedMessageIds: removed}, nil
 }
 
-func (g *GmailMonitor) fetchNewMessages(ctx context.Context) ([]*GmailMessage, error) {
+// Returns the new messages and the ids of messages that were read, archived or
+// deleted since the last check.
+func (g *GmailMonitor) fetchNewMessages(ctx context.Context) ([]*GmailMessage, []string, error) {
 	if !g.isInitialized || !g.historyId.IsValid() {
 		panic("attempted to check for messages, but GmailMonitor was not initialized. call Initialize() first")
 	}
@@ -180,6 +330,7 @@ func (g *GmailMonitor) fetchNewMessages(ctx context.Context) ([]*GmailMessage, e
 	slog.Debug("fetching new messages from gmail")
 
 	msgIds := make([]string, 0)
+	removed := make([]string, 0)
 
 	forEachPage := func(res *gmail.ListHistoryResponse) error {
 		if res.HistoryId > g.historyId.GetId() {
@@ -189,68 +340,305 @@ func (g *GmailMonitor) fetchNewMessages(ctx context.Context) ([]*GmailMessage, e
 
 		for _, h := range res.History {
 			for _, m := range h.MessagesAdded {
-				msgIds = append(msgIds, m.Message.Id)
+				if g.labels.matches(m.Message.LabelIds) {
+					msgIds = append(msgIds, m.Message.Id)
+				}
+			}
+
+			for _, m := range h.LabelsRemoved {
+				if slices.Contains(m.LabelIds, "UNREAD") || slices.Contains(m.LabelIds, "INBOX") {
+					removed = append(removed, m.Message.Id)
+				}
+			}
+
+			for _, m := range h.MessagesDeleted {
+				removed = append(removed, m.Message.Id)
 			}
 		}
 
 		return nil
 	}
 
+	// Not filtered by label on the server, since messages that lose the label
+	// would be left out
 	err := g.svc.Users.History.List("me").
 		StartHistoryId(g.historyId.GetId()).
-		HistoryTypes("messageAdded").
-		LabelId("INBOX").
+		HistoryTypes("messageAdded", "labelRemoved", "messageDeleted").
 		Pages(ctx, forEachPage)
 
 	if err != nil {
-		return []*GmailMessage{}, fmt.Errorf("error while fetching history from gmail (last history id = %d): %v", g.historyId.GetId(), err)
+		return []*GmailMessage{}, nil, fmt.Errorf("error while fetching history from gmail (last history id = %d): %w", g.historyId.GetId(), err)
+	}
+
+	return g.fetchMessages(ctx, msgIds), removed, nil
+}
+
+// Finds messages that may have been missed since the last check by listing
+// messages newer than the last reported one, then continues from the latest
+// history id.
+func (g *GmailMonitor) reconcileMessages(ctx context.Context) ([]*GmailMessage, error) {
+	// Refresh first so that messages received while listing are reported by the
+	// next check instead of being missed
+	if err := g.refreshHistoryId(ctx); err != nil {
+		return nil, fmt.Errorf("error while refreshing history id: %v", err)
+	}
+
+	since := g.lastInternalDate
+	if since.IsZero() {
+		since = g.lastCheck
 	}
 
-	group, ctx := errgroup.WithContext(ctx)
-	group.SetLimit(16) // TODO: Make configurable
+	if since.IsZero() {
+		slog.Warn("no previous check to reconcile from, messages since the history id expired will not be reported")
+		return []*GmailMessage{}, nil
+	}
+
+	slog.Debug("listing gmail messages to reconcile", "since", since)
+
+	msgIds := make([]string, 0)
 
-	msgs := make([]*GmailMessage, len(msgIds))
+	forEachPage := func(res *gmail.ListMessagesResponse) error {
+		for _, m := range res.Messages {
+			if !slices.Contains(g.recentMessageIds, m.Id) {
+				msgIds = append(msgIds, m.Id)
+			}
+		}
 
-	for i, id := range msgIds {
+		return nil
+	}
+
+	call := g.svc.Users.Messages.List("me").
+		Q(fmt.Sprintf("after:%d", since.Unix()))
+
+	// Listing by multiple labels requires all of them, so anything else is
+	// filtered after fetching
+	if len(g.labels.include) == 1 {
+		call = call.LabelIds(g.labels.include[0])
+	}
+
+	err := call.Pages(ctx, forEachPage)
+
+	if err != nil {
+		return nil, fmt.Errorf("error while listing messages from gmail (since = %s): %v", since, err)
+	}
+
+	// Listed newest first, but messages are reported oldest first
+	slices.Reverse(msgIds)
+
+	return g.fetchMessages(ctx, msgIds), nil
+}
+
+// Fetches the metadata of each message, along with messages that could not be
+// fetched by earlier checks. Messages that still can't be fetched are left out
+// of the result and retried by the next check, unless they no longer exist.
+func (g *GmailMonitor) fetchMessages(ctx context.Context, msgIds []string) []*GmailMessage {
+	pending := slices.DeleteFunc(slices.Clone(g.pendingMessageIds), func(id string) bool {
+		return slices.Contains(msgIds, id)
+	})
+	msgIds = append(pending, msgIds...)
+
+	results := make(map[string]*gmail.Message, len(msgIds))
+
+	if g.batch != nil && len(msgIds) > 1 {
+		results = g.batchGetMessages(ctx, msgIds)
+	}
+
+	// Anything the batches did not return is fetched one by one
+	remaining := slices.DeleteFunc(slices.Clone(msgIds), func(id string) bool {
+		_, ok := results[id]
+		return ok
+	})
+
+	failed := make([]string, 0)
+	if len(remaining) > 0 {
+		res, f := g.getMessages(ctx, remaining)
+		maps.Copy(results, res)
+		failed = f
+	}
+
+	if n := len(failed) - maxPendingMessageIds; n > 0 {
+		slog.Warn("too many gmail messages could not be fetched, giving up on the oldest", "numMessages", n)
+		failed = slices.Delete(failed, 0, n)
+	}
+
+	if len(failed) > 0 {
+		slog.Warn("some gmail messages could not be fetched, retrying on the next check", "numMessages", len(failed))
+	}
+
+	g.pendingMessageIds = failed
+
+	msgs := make([]*GmailMessage, 0, len(msgIds))
+	for _, id := range msgIds {
+		if res, ok := results[id]; ok {
+			if g.labels.matches(res.LabelIds) {
+				msgs = append(msgs, newGmailMessage(res))
+			}
+		}
+	}
+
+	return msgs
+}
+
+func (g *GmailMonitor) batchGetMessages(ctx context.Context, msgIds []string) map[string]*gmail.Message {
+	var mu sync.Mutex
+	results := make(map[string]*gmail.Message, len(msgIds))
+
+	var group errgroup.Group
+	group.SetLimit(g.maxConcurrentRequests())
+
+	for chunk := range slices.Chunk(msgIds, g.batchSize()) {
+		group.Go(func() error {
+			res, err := g.batch.getMessagesMetadata(ctx, chunk, gmailMetadataHeaders)
+			if err != nil {
+				slog.Warn("error while fetching batch of message metadata, falling back to individual requests", "numMessages", len(chunk), "error", err)
+			}
+
+			if len(res) < len(chunk) {
+				slog.Debug("some messages failed inside batch", "numMessages", len(chunk), "numFailed", len(chunk)-len(res))
+			}
+
+			mu.Lock()
+			maps.Copy(results, res)
+			mu.Unlock()
+
+			return nil
+		})
+	}
+
+	group.Wait()
+
+	return results
+}
+
+// Also returns the ids of messages that could not be fetched and still exist,
+// in the order of msgIds.
+func (g *GmailMonitor) getMessages(ctx context.Context, msgIds []string) (map[string]*gmail.Message, []string) {
+	var mu sync.Mutex
+	results := make(map[string]*gmail.Message, len(msgIds))
+	failed := make(map[string]bool)
+
+	var group errgroup.Group
+	group.SetLimit(g.maxConcurrentRequests())
+
+	for _, id := range msgIds {
 		group.Go(func() error {
 			res, err := g.svc.Users.Messages.Get("me", id).
 				Context(ctx).
 				Format("metadata").
-				MetadataHeaders("To", "From", "Subject").
+				MetadataHeaders(gmailMetadataHeaders...).
 				Do()
 
-			if err != nil {
-				return fmt.Errorf("error while fetching metadata for message (message id = %s): %v", id, err)
+			// 404 when the message was deleted before it could be fetched
+			var gerr *googleapi.Error
+			if errors.As(err, &gerr) && gerr.Code == http.StatusNotFound {
+				slog.Debug("message no longer exists", "messageId", id)
+				return nil
 			}
 
-			msg := &GmailMessage{}
-			for _, h := range res.Payload.Headers {
-				switch h.Name {
-				case "To":
-					msg.To = h.Value
-				case "From":
-					msg.From = h.Value
-				case "Subject":
-					msg.Subject = h.Value
-				}
+			if err != nil {
+				slog.Error("error while fetching metadata for message", "messageId", id, "error", err)
+
+				mu.Lock()
+				failed[id] = true
+				mu.Unlock()
+
+				return nil
 			}
 
-			msgs[i] = msg
+			mu.Lock()
+			results[id] = res
+			mu.Unlock()
 
 			return nil
 		})
 	}
 
-	err = group.Wait()
-	if err != nil {
-		slog.Error("error whie getting message details", "error", err)
+	group.Wait()
+
+	return results, slices.DeleteFunc(slices.Clone(msgIds), func(id string) bool { return !failed[id] })
+}
+
+func (g *GmailMonitor) batchSize() int {
+	if g.opts.BatchSize <= 0 || g.opts.BatchSize > maxGmailBatchSize {
+		return maxGmailBatchSize
 	}
 
-	msgs = slices.DeleteFunc(msgs, func(msg *GmailMessage) bool {
-		return msg == nil
-	})
+	return g.opts.BatchSize
+}
+
+func (g *GmailMonitor) maxConcurrentRequests() int {
+	if g.opts.MaxConcurrentRequests <= 0 {
+		return defaultMaxConcurrentRequests
+	}
 
-	return msgs, nil
+	return g.opts.MaxConcurrentRequests
+}
+
+func (g *GmailMonitor) recordReported(msgs []*GmailMessage) {
+	for _, msg := range msgs {
+		if msg.InternalDate.After(g.lastInternalDate) {
+			g.lastInternalDate = msg.InternalDate
+		}
+
+		g.recentMessageIds = append(g.recentMessageIds, msg.Id)
+	}
+
+	if n := len(g.recentMessageIds) - maxRecentMessageIds; n > 0 {
+		g.recentMessageIds = slices.Delete(g.recentMessageIds, 0, n)
+	}
+}
+
+func (g *GmailMonitor) restoreState() (bool, error) {
+	if g.opts.State == nil {
+		return false, nil
+	}
+
+	s := gmailMonitorState{}
+	ok, err := g.opts.State.Load(g.opts.StateKey, &s)
+	if err != nil || !ok || s.HistoryId == 0 {
+		return false, err
+	}
+
+	slog.Debug("restored gmail history id", "key", g.opts.StateKey, "historyId", s.HistoryId)
+	g.historyId.SetId(s.HistoryId)
+
+	if s.LastInternalDate != 0 {
+		g.lastInternalDate = time.UnixMilli(s.LastInternalDate)
+	}
+
+	if s.LastCheck != 0 {
+		g.lastCheck = time.UnixMilli(s.LastCheck)
+	}
+
+	g.recentMessageIds = s.RecentMessageIds
+	g.pendingMessageIds = s.PendingMessageIds
+
+	return true, nil
+}
+
+func (g *GmailMonitor) saveState() {
+	if g.opts.State == nil || !g.historyId.IsValid() {
+		return
+	}
+
+	s := gmailMonitorState{
+		HistoryId:         g.historyId.GetId(),
+		RecentMessageIds:  g.recentMessageIds,
+		PendingMessageIds: g.pendingMessageIds,
+	}
+
+	if !g.lastInternalDate.IsZero() {
+		s.LastInternalDate = g.lastInternalDate.UnixMilli()
+	}
+
+	if !g.lastCheck.IsZero() {
+		s.LastCheck = g.lastCheck.UnixMilli()
+	}
+
+	if err := g.opts.State.Save(g.opts.StateKey, &s); err != nil {
+		// Not fatal, at worst some messages are reported again after a restart
+		slog.Error("failed to save gmail monitor state", "key", g.opts.StateKey, "error", err)
+	}
 }
 
 func (g *GmailMonitor) refreshHistoryId(ctx context.Context) error {
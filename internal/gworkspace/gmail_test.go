@@ -0,0 +1,294 @@
+package gworkspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/state"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+type fakeMailboxMessage struct {
+	id           string
+	historyId    uint64
+	internalDate time.Time
+}
+
+// Serves the parts of the Gmail API used by GmailMonitor from an inbox that
+// only grows. History ids below minHistoryId have expired.
+type fakeMailbox struct {
+	t *testing.T
+
+	mu           sync.Mutex
+	msgs         []fakeMailboxMessage
+	historyId    uint64
+	minHistoryId uint64
+
+	// Requests received, for assertions
+	historyStarts []uint64
+	listQueries   []string
+}
+
+// Adds a message to the inbox and advances the history id.
+func (m *fakeMailbox) add(id string, internalDate time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.historyId += 10
+	m.msgs = append(m.msgs, fakeMailboxMessage{id: id, historyId: m.historyId, internalDate: internalDate})
+}
+
+// Expires every history id older than the current one.
+func (m *fakeMailbox) expireHistory() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.minHistoryId = m.historyId
+}
+
+func (m *fakeMailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/gmail/v1/users/me/")
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case path == "labels":
+		m.write(w, &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "INBOX", Name: "INBOX"}}})
+
+	case path == "profile":
+		m.write(w, &gmail.Profile{HistoryId: m.historyId})
+
+	case path == "history":
+		start, _ := strconv.ParseUint(r.URL.Query().Get("startHistoryId"), 10, 64)
+		m.historyStarts = append(m.historyStarts, start)
+
+		if start < m.minHistoryId {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Requested entity was not found."}}`)
+			return
+		}
+
+		res := &gmail.ListHistoryResponse{HistoryId: m.historyId}
+		for _, msg := range m.msgs {
+			if msg.historyId > start {
+				res.History = append(res.History, &gmail.History{
+					Id:            msg.historyId,
+					MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: msg.id, LabelIds: []string{"INBOX"}}}},
+				})
+			}
+		}
+
+		m.write(w, res)
+
+	case path == "messages":
+		q := r.URL.Query().Get("q")
+		m.listQueries = append(m.listQueries, q)
+
+		after, err := strconv.ParseInt(strings.TrimPrefix(q, "after:"), 10, 64)
+		if err != nil {
+			m.t.Errorf("unexpected message list query %q", q)
+		}
+
+		// Newest first, like Gmail. after: is inclusive of the second it names.
+		res := &gmail.ListMessagesResponse{}
+		for _, msg := range slices.Backward(m.msgs) {
+			if msg.internalDate.Unix() >= after {
+				res.Messages = append(res.Messages, &gmail.Message{Id: msg.id})
+			}
+		}
+
+		m.write(w, res)
+
+	case strings.HasPrefix(path, "messages/"):
+		id := strings.TrimPrefix(path, "messages/")
+		i := slices.IndexFunc(m.msgs, func(msg fakeMailboxMessage) bool { return msg.id == id })
+		if i == -1 {
+			http.NotFound(w, r)
+			return
+		}
+
+		m.write(w, &gmail.Message{
+			Id:           id,
+			ThreadId:     id,
+			LabelIds:     []string{"INBOX", "UNREAD"},
+			InternalDate: m.msgs[i].internalDate.UnixMilli(),
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *fakeMailbox) write(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		m.t.Errorf("failed to encode response: %v", err)
+	}
+}
+
+func newTestGmailMonitor(t *testing.T, mailbox *fakeMailbox, opts GmailMonitorOptions) *GmailMonitor {
+	t.Helper()
+
+	srv := httptest.NewServer(mailbox)
+	t.Cleanup(srv.Close)
+
+	svc, err := gmail.NewService(context.Background(), option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatalf("failed to create gmail service: %v", err)
+	}
+
+	return NewGmailMonitor(svc, opts)
+}
+
+func messageIds(ev *GmailEvent) []string {
+	if ev == nil {
+		return nil
+	}
+
+	ids := make([]string, len(ev.Messages))
+	for i, msg := range ev.Messages {
+		ids[i] = msg.Id
+	}
+
+	return ids
+}
+
+func TestGmailMonitorReconcilesExpiredHistoryId(t *testing.T) {
+	ctx := context.Background()
+	base := time.Now().Truncate(time.Second)
+
+	mailbox := &fakeMailbox{t: t, historyId: 100}
+	g := newTestGmailMonitor(t, mailbox, GmailMonitorOptions{})
+
+	if err := g.Initialize(ctx); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+
+	mailbox.add("seen", base.Add(time.Minute))
+
+	ev, err := g.check(ctx)
+	if err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+
+	if got := messageIds(ev); !slices.Equal(got, []string{"seen"}) {
+		t.Fatalf("first check reported %q, want [seen]", got)
+	}
+
+	mailbox.add("new1", base.Add(time.Minute*2))
+	mailbox.add("new2", base.Add(time.Minute*3))
+	mailbox.expireHistory()
+
+	ev, err = g.check(ctx)
+	if err != nil {
+		t.Fatalf("check() with an expired history id error = %v", err)
+	}
+
+	if got := messageIds(ev); !slices.Equal(got, []string{"new1", "new2"}) {
+		t.Errorf("reconciling check reported %q, want [new1 new2]", got)
+	}
+
+	wantQuery := fmt.Sprintf("after:%d", base.Add(time.Minute).Unix())
+	if !slices.Equal(mailbox.listQueries, []string{wantQuery}) {
+		t.Errorf("listed messages with %q, want [%s]", mailbox.listQueries, wantQuery)
+	}
+
+	// Continues from the fresh history id
+	mailbox.add("new3", base.Add(time.Minute*4))
+
+	ev, err = g.check(ctx)
+	if err != nil {
+		t.Fatalf("check() after reconciling error = %v", err)
+	}
+
+	if got := messageIds(ev); !slices.Equal(got, []string{"new3"}) {
+		t.Errorf("check after reconciling reported %q, want [new3]", got)
+	}
+
+	if last := mailbox.historyStarts[len(mailbox.historyStarts)-1]; last < mailbox.minHistoryId {
+		t.Errorf("check after reconciling started from expired history id %d", last)
+	}
+}
+
+func TestGmailMonitorCatchesUpFromStaleState(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	lastSeen := now.Add(-time.Hour * 24 * 7)
+
+	mailbox := &fakeMailbox{t: t, historyId: 1000}
+	mailbox.add("old", lastSeen)
+	for i := range 10 {
+		mailbox.add(fmt.Sprintf("gap%d", i), lastSeen.Add(time.Hour*time.Duration(i+1)))
+	}
+	mailbox.expireHistory()
+
+	store := state.NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	err := store.Save("gmail/test", &gmailMonitorState{
+		HistoryId:        50,
+		LastInternalDate: lastSeen.UnixMilli(),
+		LastCheck:        lastSeen.UnixMilli(),
+		RecentMessageIds: []string{"old"},
+	})
+	if err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	g := newTestGmailMonitor(t, mailbox, GmailMonitorOptions{
+		State:               store,
+		StateKey:            "gmail/test",
+		MaxMessagesPerCheck: 3,
+	})
+
+	if err := g.Initialize(ctx); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+
+	ev, err := g.check(ctx)
+	if err != nil {
+		t.Fatalf("check() with a stale restored history id error = %v", err)
+	}
+
+	if got, want := messageIds(ev), []string{"gap7", "gap8", "gap9"}; !slices.Equal(got, want) {
+		t.Errorf("catch-up check reported %q, want the newest %q", got, want)
+	}
+
+	saved := gmailMonitorState{}
+	if _, err := store.Load("gmail/test", &saved); err != nil {
+		t.Fatalf("failed to load state: %v", err)
+	}
+
+	if saved.HistoryId != mailbox.historyId {
+		t.Errorf("saved history id %d, want the fresh id %d", saved.HistoryId, mailbox.historyId)
+	}
+
+	// Messages over the cap count as seen and are not reported later
+	ev, err = g.check(ctx)
+	if err != nil {
+		t.Fatalf("check() after catching up error = %v", err)
+	}
+
+	if ev != nil {
+		t.Errorf("check after catching up reported %q, want nothing", messageIds(ev))
+	}
+
+	if last := mailbox.historyStarts[len(mailbox.historyStarts)-1]; last != saved.HistoryId {
+		t.Errorf("check after catching up started from history id %d, want %d", last, saved.HistoryId)
+	}
+}
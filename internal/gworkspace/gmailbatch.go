@@ -0,0 +1,162 @@
+package gworkspace
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// Gmail rejects batches with more than 100 requests
+	maxGmailBatchSize = 100
+)
+
+// Sends many Messages.Get requests in a single round trip using the Gmail batch
+// endpoint.
+// See https://developers.google.com/gmail/api/guides/batch
+type gmailBatchClient struct {
+	client *http.Client
+
+	// Root url of the api, e.g. https://gmail.googleapis.com/
+	basePath string
+}
+
+func newGmailBatchClient(client *http.Client, basePath string) *gmailBatchClient {
+	return &gmailBatchClient{
+		client:   client,
+		basePath: basePath,
+	}
+}
+
+// Fetches the metadata of each message in a single batch request. Messages that
+// failed inside the batch are missing from the returned map, the error is only
+// set if the batch itself failed.
+func (c *gmailBatchClient) getMessagesMetadata(ctx context.Context, msgIds []string, headers []string) (map[string]*gmail.Message, error) {
+	if len(msgIds) > maxGmailBatchSize {
+		return nil, fmt.Errorf("batch of %d messages exceeds maximum batch size of %d", len(msgIds), maxGmailBatchSize)
+	}
+
+	base, err := url.Parse(c.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse base path (%s): %v", c.basePath, err)
+	}
+
+	query := url.Values{}
+	query.Set("format", "metadata")
+	for _, h := range headers {
+		query.Add("metadataHeaders", h)
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+
+	for i, id := range msgIds {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<item-%d>", i)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		path := base.JoinPath("gmail/v1/users/me/messages", id).Path
+		fmt.Fprintf(part, "GET %s?%s HTTP/1.1\r\n\r\n", path, query.Encode())
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base.JoinPath("batch/gmail/v1").String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error while sending batch request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("batch request responded with status %s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("unexpected batch response content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	results := make(map[string]*gmail.Message, len(msgIds))
+	mr := multipart.NewReader(res.Body, params["boundary"])
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return results, fmt.Errorf("failed to read batch response: %v", err)
+		}
+
+		i, ok := parseBatchContentId(part.Header.Get("Content-Id"))
+		if !ok || i < 0 || i >= len(msgIds) {
+			continue
+		}
+
+		partRes, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			continue
+		}
+
+		if partRes.StatusCode != http.StatusOK {
+			partRes.Body.Close()
+			continue
+		}
+
+		msg := &gmail.Message{}
+		err = json.NewDecoder(partRes.Body).Decode(msg)
+		partRes.Body.Close()
+
+		if err != nil {
+			continue
+		}
+
+		results[msgIds[i]] = msg
+	}
+
+	return results, nil
+}
+
+// Parses the index from a response content id of the form <response-item-N>
+func parseBatchContentId(id string) (int, bool) {
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+
+	n, ok := strings.CutPrefix(id, "response-item-")
+	if !ok {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(n)
+	if err != nil {
+		return 0, false
+	}
+
+	return i, true
+}
@@ -0,0 +1,379 @@
+package gworkspace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// Request inside a batch as received by fakeGmailServer
+type fakeBatchItem struct {
+	contentType string
+	contentId   string
+	method      string
+	path        string
+	query       map[string][]string
+}
+
+// Serves the Gmail batch endpoint and Messages.Get. Messages are answered with
+// the status in batchStatuses or getStatuses, 200 if missing.
+type fakeGmailServer struct {
+	t *testing.T
+
+	// Status of the batch request itself, 200 if 0
+	batchStatus   int
+	batchStatuses map[string]int
+	getStatuses   map[string]int
+
+	mu      sync.Mutex
+	batches [][]fakeBatchItem
+	// Ids of messages fetched with individual requests
+	gets []string
+}
+
+func (s *fakeGmailServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/batch/gmail/v1" {
+		s.serveBatch(w, r)
+		return
+	}
+
+	id, ok := strings.CutPrefix(r.URL.Path, "/gmail/v1/users/me/messages/")
+	if r.Method != http.MethodGet || !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.gets = append(s.gets, id)
+	s.mu.Unlock()
+
+	status, body := fakeGmailMessage(id, s.getStatuses)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (s *fakeGmailServer) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if s.batchStatus != 0 && s.batchStatus != http.StatusOK {
+		http.Error(w, "backend error", s.batchStatus)
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		s.t.Errorf("batch request content type = %q, want multipart/mixed", r.Header.Get("Content-Type"))
+		http.Error(w, "bad content type", http.StatusBadRequest)
+		return
+	}
+
+	var items []fakeBatchItem
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			s.t.Errorf("failed to read batch item: %v", err)
+			http.Error(w, "bad batch item", http.StatusBadRequest)
+			return
+		}
+
+		items = append(items, fakeBatchItem{
+			contentType: part.Header.Get("Content-Type"),
+			contentId:   part.Header.Get("Content-Id"),
+			method:      req.Method,
+			path:        req.URL.Path,
+			query:       req.URL.Query(),
+		})
+	}
+
+	s.mu.Lock()
+	s.batches = append(s.batches, items)
+	s.mu.Unlock()
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	for i, item := range items {
+		part, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<response-item-%d>", i)},
+		})
+
+		id := item.path[strings.LastIndex(item.path, "/")+1:]
+		status, body := fakeGmailMessage(id, s.batchStatuses)
+		fmt.Fprintf(part, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\n\r\n%s", status, http.StatusText(status), body)
+	}
+
+	mw.Close()
+}
+
+func fakeGmailMessage(id string, statuses map[string]int) (int, []byte) {
+	status, ok := statuses[id]
+	if !ok {
+		status = http.StatusOK
+	}
+
+	if status != http.StatusOK {
+		return status, fmt.Appendf(nil, `{"error":{"code":%d,"message":"%s"}}`, status, http.StatusText(status))
+	}
+
+	body, _ := json.Marshal(&gmail.Message{
+		Id:       id,
+		ThreadId: "thread-" + id,
+		LabelIds: []string{"INBOX"},
+	})
+
+	return http.StatusOK, body
+}
+
+func TestGmailBatchRequestEncoding(t *testing.T) {
+	fake := &fakeGmailServer{t: t}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := newGmailBatchClient(srv.Client(), srv.URL+"/")
+	msgIds := []string{"a1", "b2", "c3"}
+
+	res, err := c.getMessagesMetadata(context.Background(), msgIds, []string{"From", "Subject"})
+	if err != nil {
+		t.Fatalf("getMessagesMetadata() error = %v", err)
+	}
+
+	if len(fake.batches) != 1 {
+		t.Fatalf("sent %d batch requests, want 1", len(fake.batches))
+	}
+
+	items := fake.batches[0]
+	if len(items) != len(msgIds) {
+		t.Fatalf("batch has %d items, want %d", len(items), len(msgIds))
+	}
+
+	for i, item := range items {
+		if item.contentType != "application/http" {
+			t.Errorf("item %d content type = %q, want application/http", i, item.contentType)
+		}
+
+		if want := fmt.Sprintf("<item-%d>", i); item.contentId != want {
+			t.Errorf("item %d content id = %q, want %q", i, item.contentId, want)
+		}
+
+		if item.method != http.MethodGet {
+			t.Errorf("item %d method = %s, want GET", i, item.method)
+		}
+
+		if want := "/gmail/v1/users/me/messages/" + msgIds[i]; item.path != want {
+			t.Errorf("item %d path = %q, want %q", i, item.path, want)
+		}
+
+		if got := item.query["format"]; !slices.Equal(got, []string{"metadata"}) {
+			t.Errorf("item %d format = %q, want metadata", i, got)
+		}
+
+		if got := item.query["metadataHeaders"]; !slices.Equal(got, []string{"From", "Subject"}) {
+			t.Errorf("item %d metadataHeaders = %q, want [From Subject]", i, got)
+		}
+	}
+
+	for _, id := range msgIds {
+		if msg, ok := res[id]; !ok || msg.Id != id || msg.ThreadId != "thread-"+id {
+			t.Errorf("result for %s = %+v, want message %s", id, msg, id)
+		}
+	}
+}
+
+func TestGmailBatchMixedResponses(t *testing.T) {
+	fake := &fakeGmailServer{
+		t: t,
+		batchStatuses: map[string]int{
+			"missing": http.StatusNotFound,
+			"limited": http.StatusTooManyRequests,
+		},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := newGmailBatchClient(srv.Client(), srv.URL+"/")
+
+	res, err := c.getMessagesMetadata(context.Background(), []string{"ok1", "missing", "limited", "ok2"}, nil)
+	if err != nil {
+		t.Fatalf("getMessagesMetadata() error = %v", err)
+	}
+
+	got := make([]string, 0, len(res))
+	for id := range res {
+		got = append(got, id)
+	}
+	slices.Sort(got)
+
+	if want := []string{"ok1", "ok2"}; !slices.Equal(got, want) {
+		t.Errorf("returned messages %q, want %q", got, want)
+	}
+}
+
+func TestGmailBatchFailure(t *testing.T) {
+	fake := &fakeGmailServer{t: t, batchStatus: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := newGmailBatchClient(srv.Client(), srv.URL+"/")
+
+	res, err := c.getMessagesMetadata(context.Background(), []string{"a1", "b2"}, nil)
+	if err == nil {
+		t.Fatalf("getMessagesMetadata() = %v, want error", res)
+	}
+}
+
+func TestGmailBatchTooLarge(t *testing.T) {
+	c := newGmailBatchClient(http.DefaultClient, "http://127.0.0.1:0/")
+
+	msgIds := make([]string, maxGmailBatchSize+1)
+	for i := range msgIds {
+		msgIds[i] = fmt.Sprint(i)
+	}
+
+	if _, err := c.getMessagesMetadata(context.Background(), msgIds, nil); err == nil {
+		t.Fatal("getMessagesMetadata() succeeded, want error for oversized batch")
+	}
+}
+
+func TestGmailFetchMessagesFallback(t *testing.T) {
+	tests := []struct {
+		name          string
+		batchStatus   int
+		batchStatuses map[string]int
+		getStatuses   map[string]int
+		// Messages expected to be fetched one by one
+		wantGets []string
+		want     []string
+		// Messages left for the next check
+		wantPending []string
+	}{
+		{
+			name: "all in batch",
+			want: []string{"a1", "b2", "c3", "d4"},
+		},
+		{
+			name:          "partial failure",
+			batchStatuses: map[string]int{"b2": http.StatusTooManyRequests, "d4": http.StatusNotFound},
+			// d4 fails again on its own and is left out
+			getStatuses: map[string]int{"d4": http.StatusNotFound},
+			wantGets:    []string{"b2", "d4"},
+			want:        []string{"a1", "b2", "c3"},
+		},
+		{
+			name:          "still failing",
+			batchStatuses: map[string]int{"b2": http.StatusTooManyRequests, "d4": http.StatusNotFound},
+			getStatuses:   map[string]int{"b2": http.StatusServiceUnavailable, "d4": http.StatusNotFound},
+			wantGets:      []string{"b2", "d4"},
+			want:          []string{"a1", "c3"},
+			// d4 was deleted, so only b2 is worth retrying
+			wantPending: []string{"b2"},
+		},
+		{
+			name:        "batch failure",
+			batchStatus: http.StatusInternalServerError,
+			wantGets:    []string{"a1", "b2", "c3", "d4"},
+			want:        []string{"a1", "b2", "c3", "d4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeGmailServer{t: t, batchStatus: tt.batchStatus, batchStatuses: tt.batchStatuses, getStatuses: tt.getStatuses}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+
+			svc, err := gmail.NewService(context.Background(), option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+			if err != nil {
+				t.Fatalf("failed to create gmail service: %v", err)
+			}
+
+			g := NewGmailMonitor(svc, GmailMonitorOptions{HttpClient: srv.Client()})
+			g.labels = &gmailLabelIdFilter{include: []string{"INBOX"}}
+
+			msgs := g.fetchMessages(context.Background(), []string{"a1", "b2", "c3", "d4"})
+
+			got := make([]string, 0, len(msgs))
+			for _, msg := range msgs {
+				got = append(got, msg.Id)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("fetched %q, want %q in order", got, tt.want)
+			}
+
+			slices.Sort(fake.gets)
+
+			if !slices.Equal(fake.gets, tt.wantGets) {
+				t.Errorf("fetched %q individually, want %q", fake.gets, tt.wantGets)
+			}
+
+			if tt.batchStatus == 0 && len(fake.batches) != 1 {
+				t.Errorf("sent %d batch requests, want 1", len(fake.batches))
+			}
+
+			if !slices.Equal(g.pendingMessageIds, tt.wantPending) {
+				t.Errorf("left %q for the next check, want %q", g.pendingMessageIds, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestGmailFetchMessagesRetriesFailedMessages(t *testing.T) {
+	fake := &fakeGmailServer{
+		t:             t,
+		batchStatuses: map[string]int{"b2": http.StatusInternalServerError},
+		getStatuses:   map[string]int{"b2": http.StatusInternalServerError},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	svc, err := gmail.NewService(context.Background(), option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatalf("failed to create gmail service: %v", err)
+	}
+
+	g := NewGmailMonitor(svc, GmailMonitorOptions{HttpClient: srv.Client()})
+	g.labels = &gmailLabelIdFilter{include: []string{"INBOX"}}
+
+	ids := func(msgs []*GmailMessage) []string {
+		ids := make([]string, len(msgs))
+		for i, msg := range msgs {
+			ids[i] = msg.Id
+		}
+
+		return ids
+	}
+
+	if got := ids(g.fetchMessages(context.Background(), []string{"a1", "b2"})); !slices.Equal(got, []string{"a1"}) {
+		t.Fatalf("first fetch returned %q, want [a1]", got)
+	}
+
+	fake.batchStatuses = nil
+	fake.getStatuses = nil
+
+	if got := ids(g.fetchMessages(context.Background(), []string{"c3"})); !slices.Equal(got, []string{"b2", "c3"}) {
+		t.Errorf("second fetch returned %q, want the retried b2 before c3", got)
+	}
+
+	if len(g.pendingMessageIds) != 0 {
+		t.Errorf("left %q for the next check, want nothing", g.pendingMessageIds)
+	}
+}
@@ -0,0 +1,176 @@
+package gworkspace
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Everything that changed in the mailbox during a single check.
+type GmailEvent struct {
+	// Oldest first
+	Messages []*GmailMessage
+	// Ids of previously reported messages that have since been marked as read,
+	// removed from the inbox or deleted
+	RemovedMessageIds []string
+}
+
+// What happens to events sent to a subscriber whose buffer is full.
+type GmailOverflowPolicy string
+
+const (
+	// Discards the oldest buffered event to make room
+	GmailOverflowPolicy_DropOldest GmailOverflowPolicy = "dropOldest"
+	// Merges every buffered event into one, so nothing is lost
+	GmailOverflowPolicy_Coalesce GmailOverflowPolicy = "coalesce"
+	// Waits up to SubscribeOptions.BlockTimeout for room, then discards the event
+	GmailOverflowPolicy_Block GmailOverflowPolicy = "block"
+)
+
+const (
+	defaultSubscriptionBufferSize   = 32
+	defaultSubscriptionBlockTimeout = time.Second * 10
+)
+
+type GmailSubscribeOptions struct {
+	// Defaults to 32
+	BufferSize int
+	// Defaults to GmailOverflowPolicy_Coalesce
+	Overflow GmailOverflowPolicy
+	// Only used by GmailOverflowPolicy_Block. Defaults to 10 seconds.
+	BlockTimeout time.Duration
+}
+
+type GmailSubscription struct {
+	opts   GmailSubscribeOptions
+	events chan *GmailEvent
+}
+
+// Receives events until the subscription is removed with Unsubscribe, which
+// closes the channel.
+func (s *GmailSubscription) Events() <-chan *GmailEvent {
+	return s.events
+}
+
+// Subscribers of a GmailMonitor. Sending never holds up the monitor for longer
+// than the overflow policy of the slowest subscriber allows.
+type gmailSubscribers struct {
+	mu   sync.RWMutex
+	subs []*GmailSubscription
+}
+
+func (s *gmailSubscribers) add(opts GmailSubscribeOptions) *GmailSubscription {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultSubscriptionBufferSize
+	}
+
+	if opts.Overflow == "" {
+		opts.Overflow = GmailOverflowPolicy_Coalesce
+	}
+
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultSubscriptionBlockTimeout
+	}
+
+	sub := &GmailSubscription{
+		opts:   opts,
+		events: make(chan *GmailEvent, opts.BufferSize),
+	}
+
+	s.mu.Lock()
+	s.subs = append(s.subs, sub)
+	s.mu.Unlock()
+
+	return sub
+}
+
+func (s *gmailSubscribers) remove(sub *GmailSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.Index(s.subs, sub)
+	if i == -1 {
+		return
+	}
+
+	s.subs = slices.Delete(s.subs, i, i+1)
+	close(sub.events)
+}
+
+// Sends ev to every subscriber. Subscribers must not modify it.
+func (s *gmailSubscribers) send(ev *GmailEvent) {
+	// Held for reading so that Unsubscribe can't close a channel that is being
+	// sent to
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, sub := range s.subs {
+		sub.send(ev)
+	}
+}
+
+func (sub *GmailSubscription) send(ev *GmailEvent) {
+	select {
+	case sub.events <- ev:
+		return
+	default:
+	}
+
+	switch sub.opts.Overflow {
+	case GmailOverflowPolicy_DropOldest:
+		for {
+			select {
+			case sub.events <- ev:
+				return
+			default:
+			}
+
+			select {
+			case dropped := <-sub.events:
+				slog.Warn("gmail subscriber is not keeping up, dropped oldest event", "numMessages", len(dropped.Messages))
+			default:
+			}
+		}
+
+	case GmailOverflowPolicy_Block:
+		timer := time.NewTimer(sub.opts.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case sub.events <- ev:
+		case <-timer.C:
+			slog.Warn("gmail subscriber is not keeping up, dropped event", "numMessages", len(ev.Messages))
+		}
+
+	default:
+		merged := &GmailEvent{}
+
+	drain:
+		for {
+			select {
+			case buffered := <-sub.events:
+				merged = mergeGmailEvents(merged, buffered)
+			default:
+				break drain
+			}
+		}
+
+		// Only the monitor sends, one event at a time, so the buffer that was
+		// just emptied has room
+		sub.events <- mergeGmailEvents(merged, ev)
+	}
+}
+
+// Combines two events, a is older than b. Messages removed in b are left out
+// of the combined messages, they are no longer worth reporting.
+func mergeGmailEvents(a, b *GmailEvent) *GmailEvent {
+	msgs := slices.DeleteFunc(slices.Concat(a.Messages, b.Messages), func(msg *GmailMessage) bool {
+		return slices.Contains(b.RemovedMessageIds, msg.Id)
+	})
+
+	return &GmailEvent{
+		Messages:          msgs,
+		RemovedMessageIds: slices.Concat(a.RemovedMessageIds, b.RemovedMessageIds),
+	}
+}
@@ -0,0 +1,116 @@
+package gworkspace
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Calendar invitation carried by an email as a text/calendar part.
+// See https://www.rfc-editor.org/rfc/rfc6047
+type GmailCalendarInvite struct {
+	// Such as "REQUEST" for invitations or "CANCEL" for cancellations
+	Method string
+	// Same as the iCalUID of the event in Google Calendar
+	UID string
+}
+
+// Fetches the calendar invitation attached to the message. Returns nil if the
+// message has none.
+func FetchGmailCalendarInvite(ctx context.Context, svc *gmail.Service, msgId string) (*GmailCalendarInvite, error) {
+	// Only the structure and the inline data, not the whole message
+	res, err := svc.Users.Messages.Get("me", msgId).
+		Format("full").
+		Fields("payload(mimeType,body,parts(mimeType,body,parts(mimeType,body,parts(mimeType,body))))").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching message %s: %v", msgId, err)
+	}
+
+	part := findGmailPart(res.Payload, "text/calendar")
+	if part == nil || part.Body == nil {
+		return nil, nil
+	}
+
+	data := part.Body.Data
+	if data == "" && part.Body.AttachmentId != "" {
+		att, err := svc.Users.Messages.Attachments.Get("me", msgId, part.Body.AttachmentId).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("error while fetching calendar part of message %s: %v", msgId, err)
+		}
+
+		data = att.Data
+	}
+
+	// Gmail may leave out the padding
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid calendar part in message %s: %v", msgId, err)
+	}
+
+	return parseCalendarInvite(string(b)), nil
+}
+
+// Depth first search for the first part with the media type.
+func findGmailPart(part *gmail.MessagePart, mediaType string) *gmail.MessagePart {
+	if part == nil {
+		return nil
+	}
+
+	if strings.EqualFold(strings.TrimSpace(strings.Split(part.MimeType, ";")[0]), mediaType) {
+		return part
+	}
+
+	for _, p := range part.Parts {
+		if found := findGmailPart(p, mediaType); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// Reads the method and the UID of the first event from an iCalendar object.
+// Returns nil if it has no event.
+// See https://www.rfc-editor.org/rfc/rfc5545
+func parseCalendarInvite(ics string) *GmailCalendarInvite {
+	// Long lines are folded by continuing them on lines that start with a space
+	// or tab
+	ics = strings.ReplaceAll(ics, "\r\n", "\n")
+	ics = strings.ReplaceAll(ics, "\n ", "")
+	ics = strings.ReplaceAll(ics, "\n\t", "")
+
+	invite := &GmailCalendarInvite{}
+	inEvent := false
+
+	for _, line := range strings.Split(ics, "\n") {
+		// Properties may have parameters, such as UID;X-PARAM=1:value
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		name, _, _ = strings.Cut(name, ";")
+
+		switch strings.ToUpper(name) {
+		case "METHOD":
+			invite.Method = strings.ToUpper(strings.TrimSpace(value))
+		case "BEGIN":
+			inEvent = inEvent || strings.EqualFold(strings.TrimSpace(value), "VEVENT")
+		case "UID":
+			if inEvent && invite.UID == "" {
+				invite.UID = strings.TrimSpace(value)
+			}
+		}
+	}
+
+	if invite.UID == "" {
+		return nil
+	}
+
+	return invite
+}
@@ -0,0 +1,124 @@
+package gworkspace
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	defaultGmailIncludeLabel = "INBOX"
+)
+
+// Selects which messages are reported by a GmailMonitor. Labels are given by
+// id (e.g. INBOX, CATEGORY_PROMOTIONS, Label_123) or by name (e.g. Work/Urgent).
+type GmailLabelFilter struct {
+	// Messages must have at least one of these labels. Defaults to INBOX.
+	Include []string
+	// Messages with any of these labels are never reported.
+	Exclude []string
+}
+
+// Label filter with all names resolved to label ids
+type gmailLabelIdFilter struct {
+	include []string
+	exclude []string
+}
+
+func (f *gmailLabelIdFilter) matches(labelIds []string) bool {
+	for _, id := range labelIds {
+		if slices.Contains(f.exclude, id) {
+			return false
+		}
+	}
+
+	for _, id := range labelIds {
+		if slices.Contains(f.include, id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Labels of a mailbox, for looking up label ids by name
+type GmailLabels struct {
+	labels []*gmail.Label
+}
+
+func NewGmailLabels(labels []*gmail.Label) *GmailLabels {
+	return &GmailLabels{labels: labels}
+}
+
+func listGmailLabels(ctx context.Context, svc *gmail.Service) (*GmailLabels, error) {
+	res, err := svc.Users.Labels.List("me").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error while listing gmail labels: %v", err)
+	}
+
+	return NewGmailLabels(res.Labels), nil
+}
+
+// Returns the id of the label with the given id or name.
+func (l *GmailLabels) Id(idOrName string) (string, bool) {
+	return findGmailLabelId(l.labels, idOrName)
+}
+
+// Returns the ids of the labels given by id or name. Labels that don't exist
+// are left out with a warning.
+func (l *GmailLabels) Ids(idsOrNames []string) []string {
+	ids := make([]string, 0, len(idsOrNames))
+	for _, idOrName := range idsOrNames {
+		id, ok := l.Id(idOrName)
+		if !ok {
+			slog.Warn("gmail label does not exist, ignoring it", "label", idOrName)
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Resolves the label names in filter to ids. Labels that don't exist are left
+// out with a warning.
+func resolveGmailLabelFilter(labels *GmailLabels, filter GmailLabelFilter) (*gmailLabelIdFilter, error) {
+	include := filter.Include
+	if len(include) == 0 {
+		include = []string{defaultGmailIncludeLabel}
+	}
+
+	f := &gmailLabelIdFilter{
+		include: labels.Ids(include),
+		exclude: labels.Ids(filter.Exclude),
+	}
+
+	if len(f.include) == 0 {
+		return nil, fmt.Errorf("none of the included gmail labels exist: %s", strings.Join(include, ", "))
+	}
+
+	return f, nil
+}
+
+// Ids take precedence over names. Names are compared case-insensitively like
+// Gmail does.
+func findGmailLabelId(labels []*gmail.Label, idOrName string) (string, bool) {
+	for _, l := range labels {
+		if l.Id == idOrName {
+			return l.Id, true
+		}
+	}
+
+	for _, l := range labels {
+		if strings.EqualFold(l.Name, idOrName) {
+			return l.Id, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,132 @@
+package gworkspace
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+var gmailMetadataHeaders = []string{"To", "Cc", "From", "Subject", "Date", "List-Id", "Content-Type"}
+
+type GmailMessage struct {
+	Id           string
+	ThreadId     string
+	InternalDate time.Time
+	// From the Date header, zero if missing or invalid
+	Date     time.Time
+	Snippet  string
+	LabelIds []string
+
+	// nil if the header is missing
+	From    *mail.Address
+	To      []*mail.Address
+	Cc      []*mail.Address
+	Subject string
+	ListId  string
+
+	// Guessed from the top level content type since attachments are not part of
+	// the message metadata
+	HasAttachments bool
+}
+
+// Returns the display name of the sender, falling back to the address.
+func (m *GmailMessage) Sender() string {
+	if m.From == nil {
+		return ""
+	}
+
+	if m.From.Name != "" {
+		return m.From.Name
+	}
+
+	return m.From.Address
+}
+
+// Decodes RFC 2047 encoded words in any charset known to the WHATWG encoding
+// standard, not just the few supported by the standard library.
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported charset: %s", charset)
+		}
+
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+func newGmailMessage(res *gmail.Message) *GmailMessage {
+	msg := &GmailMessage{
+		Id:           res.Id,
+		ThreadId:     res.ThreadId,
+		InternalDate: time.UnixMilli(res.InternalDate),
+		// Gmail escapes html entities in snippets
+		Snippet:  html.UnescapeString(res.Snippet),
+		LabelIds: res.LabelIds,
+	}
+
+	if res.Payload == nil {
+		return msg
+	}
+
+	for _, h := range res.Payload.Headers {
+		switch h.Name {
+		case "To":
+			msg.To = parseAddressList(h.Value)
+		case "Cc":
+			msg.Cc = parseAddressList(h.Value)
+		case "From":
+			msg.From = parseAddress(h.Value)
+		case "Subject":
+			msg.Subject = decodeHeader(h.Value)
+		case "Date":
+			if date, err := mail.ParseDate(h.Value); err == nil {
+				msg.Date = date
+			}
+		case "List-Id":
+			msg.ListId = decodeHeader(h.Value)
+		case "Content-Type":
+			mediaType, _, _ := mime.ParseMediaType(h.Value)
+			msg.HasAttachments = mediaType == "multipart/mixed"
+		}
+	}
+
+	return msg
+}
+
+func decodeHeader(v string) string {
+	decoded, err := headerDecoder.DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+
+	return decoded
+}
+
+// Malformed addresses are kept as a name so they can still be displayed.
+func parseAddress(v string) *mail.Address {
+	addr, err := addressParser.Parse(v)
+	if err != nil {
+		return &mail.Address{Name: strings.TrimSpace(decodeHeader(v))}
+	}
+
+	return addr
+}
+
+func parseAddressList(v string) []*mail.Address {
+	addrs, err := addressParser.ParseList(v)
+	if err != nil {
+		return []*mail.Address{{Name: strings.TrimSpace(decodeHeader(v))}}
+	}
+
+	return addrs
+}
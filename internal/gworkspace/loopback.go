@@ -0,0 +1,148 @@
+package gworkspace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/browser"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultLoopbackTimeout = time.Minute * 5
+)
+
+// Authorization code flow that receives the code through a redirect to a
+// short-lived HTTP server bound to the loopback interface.
+// See https://developers.google.com/identity/protocols/oauth2/native-app#redirect-uri_loopback
+type loopbackFlow struct {
+	// Called with the authorization URL. Defaults to opening the system browser.
+	openUrl func(url string) error
+	timeout time.Duration
+}
+
+func newLoopbackFlow() *loopbackFlow {
+	return &loopbackFlow{
+		openUrl: browser.Open,
+		timeout: defaultLoopbackTimeout,
+	}
+}
+
+type loopbackResult struct {
+	code string
+	err  error
+}
+
+func (f *loopbackFlow) Token(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on loopback interface: %v", err)
+	}
+
+	// Copy so that the redirect url does not leak into the caller's config
+	loopbackCfg := *cfg
+	loopbackCfg.RedirectURL = fmt.Sprintf("http://%s/", ln.Addr().String())
+
+	state, err := randomState()
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to generate state token: %v", err)
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	results := make(chan loopbackResult, 1)
+	server := &http.Server{
+		Handler:           loopbackHandler(state, results),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("loopback oauth server exited unexpectedly", "error", err)
+		}
+	}()
+	defer server.Close()
+
+	opts = append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier)}, opts...)
+	authUrl := loopbackCfg.AuthCodeURL(state, opts...)
+
+	slog.Info("waiting for oauth authorization in the browser", "url", authUrl)
+	if err := f.openUrl(authUrl); err != nil {
+		// The url is logged above so the user can still open it manually
+		slog.Warn("failed to open browser for oauth authorization", "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	var res loopbackResult
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting for oauth redirect: %v", ctx.Err())
+	}
+
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	tok, err := loopbackCfg.Exchange(ctx, res.code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange for auth token: %v", err)
+	}
+
+	return tok, nil
+}
+
+func loopbackHandler(state string, results chan<- loopbackResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		// Ignore stray requests (e.g. favicon) that don't carry a response
+		if !q.Has("state") {
+			http.NotFound(w, r)
+			return
+		}
+
+		var res loopbackResult
+		switch {
+		case q.Get("state") != state:
+			res.err = errors.New("oauth redirect state does not match")
+		case q.Has("error"):
+			res.err = fmt.Errorf("oauth authorization failed: %s", q.Get("error"))
+		case q.Get("code") == "":
+			res.err = errors.New("oauth redirect did not include an authorization code")
+		default:
+			res.code = q.Get("code")
+		}
+
+		if res.err != nil {
+			http.Error(w, "Authorization failed. You may close this window.", http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "Authorization complete. You may close this window.")
+		}
+
+		select {
+		case results <- res:
+		default:
+			// A result has already been delivered
+		}
+	})
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
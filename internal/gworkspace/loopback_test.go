@@ -0,0 +1,252 @@
+package gworkspace
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Authorization server that issues a token for the code "test-code" when the
+// verifier matches the challenge of the authorization request.
+type fakeAuthServer struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	challenge string
+	// Number of token requests received
+	exchanges int
+}
+
+func (s *fakeAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/token" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.exchanges++
+	challenge := s.challenge
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if got := base64.RawURLEncoding.EncodeToString(sum[:]); got != challenge {
+		s.t.Errorf("code verifier hashes to %q, want challenge %q", got, challenge)
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	if code := r.PostForm.Get("code"); code != "test-code" {
+		s.t.Errorf("exchanged code %q, want test-code", code)
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  "test-access-token",
+		"refresh_token": "test-refresh-token",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+// Runs the flow, answering the authorization request with the redirect query
+// returned by redirect. Returns the token and the address the flow listened on.
+func runLoopbackFlow(t *testing.T, auth *fakeAuthServer, authUrl string, redirect func(state string) url.Values) (*oauth2.Token, string, error) {
+	t.Helper()
+
+	cfg := &oauth2.Config{
+		ClientID: "test-client",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  authUrl + "/auth",
+			TokenURL: authUrl + "/token",
+		},
+		Scopes: []string{"test-scope"},
+	}
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	var redirectAddr string
+	flow := &loopbackFlow{
+		timeout: time.Second * 5,
+		openUrl: func(rawUrl string) error {
+			u, err := url.Parse(rawUrl)
+			if err != nil {
+				return err
+			}
+
+			q := u.Query()
+			if got := q.Get("code_challenge_method"); got != "S256" {
+				t.Errorf("code_challenge_method = %q, want S256", got)
+			}
+
+			if q.Get("code_challenge") == "" {
+				t.Error("authorization url has no code_challenge")
+			}
+
+			if q.Get("state") == "" {
+				t.Error("authorization url has no state")
+			}
+
+			auth.mu.Lock()
+			auth.challenge = q.Get("code_challenge")
+			auth.mu.Unlock()
+
+			redirectUri, err := url.Parse(q.Get("redirect_uri"))
+			if err != nil {
+				return err
+			}
+
+			if host, _, _ := net.SplitHostPort(redirectUri.Host); host != "127.0.0.1" {
+				t.Errorf("redirect uri %s is not on the loopback interface", redirectUri)
+			}
+
+			redirectAddr = redirectUri.Host
+			redirectUri.RawQuery = redirect(q.Get("state")).Encode()
+
+			res, err := client.Get(redirectUri.String())
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+
+			return nil
+		},
+	}
+
+	tok, err := flow.Token(context.Background(), cfg)
+
+	return tok, redirectAddr, err
+}
+
+func TestLoopbackFlow(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect func(state string) url.Values
+		// Substring of the expected error, empty if the flow should succeed
+		wantErr string
+	}{
+		{
+			name: "success",
+			redirect: func(state string) url.Values {
+				return url.Values{"state": {state}, "code": {"test-code"}}
+			},
+		},
+		{
+			name: "mismatched state",
+			redirect: func(state string) url.Values {
+				return url.Values{"state": {state + "x"}, "code": {"test-code"}}
+			},
+			wantErr: "state does not match",
+		},
+		{
+			name: "access denied",
+			redirect: func(state string) url.Values {
+				return url.Values{"state": {state}, "error": {"access_denied"}}
+			},
+			wantErr: "access_denied",
+		},
+		{
+			name: "missing code",
+			redirect: func(state string) url.Values {
+				return url.Values{"state": {state}}
+			},
+			wantErr: "authorization code",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &fakeAuthServer{t: t}
+			srv := httptest.NewServer(auth)
+			defer srv.Close()
+
+			tok, redirectAddr, err := runLoopbackFlow(t, auth, srv.URL, tt.redirect)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Token() error = %v", err)
+				}
+
+				if tok.AccessToken != "test-access-token" || tok.RefreshToken != "test-refresh-token" {
+					t.Errorf("Token() = %+v, want the issued token", tok)
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Token() error = %v, want error containing %q", err, tt.wantErr)
+				}
+
+				if auth.exchanges != 0 {
+					t.Errorf("exchanged code %d times after a failed redirect, want 0", auth.exchanges)
+				}
+			}
+
+			if conn, err := net.Dial("tcp", redirectAddr); err == nil {
+				conn.Close()
+				t.Errorf("loopback listener on %s still accepts connections", redirectAddr)
+			}
+		})
+	}
+}
+
+func TestLoopbackHandlerIgnoresStrayRequests(t *testing.T) {
+	results := make(chan loopbackResult, 1)
+	h := loopbackHandler("test-state", results)
+
+	// Browsers request the favicon of the redirect page
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("stray request status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	select {
+	case res := <-results:
+		t.Fatalf("stray request delivered result %+v", res)
+	default:
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?state=test-state&code=test-code", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("redirect status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if res := <-results; res.err != nil || res.code != "test-code" {
+		t.Errorf("redirect delivered %+v, want code test-code", res)
+	}
+}
+
+func TestLoopbackFlowTimeout(t *testing.T) {
+	flow := &loopbackFlow{
+		timeout: time.Millisecond * 50,
+		openUrl: func(string) error { return nil },
+	}
+
+	cfg := &oauth2.Config{
+		ClientID: "test-client",
+		Endpoint: oauth2.Endpoint{AuthURL: "http://127.0.0.1:0/auth", TokenURL: "http://127.0.0.1:0/token"},
+	}
+
+	if _, err := flow.Token(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Token() error = %v, want timeout", err)
+	}
+}
@@ -0,0 +1,214 @@
+package gworkspace
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxRetries    = 5
+	defaultMinBackoff    = time.Second
+	defaultMaxBackoff    = time.Minute
+	defaultMaxRetryAfter = time.Minute * 5
+
+	// Only this much of a 403 response body is inspected for rate limit reasons
+	maxRateLimitBodySize = 64 * 1024
+)
+
+// Round tripper that retries requests rejected for quota or server errors using
+// jittered exponential backoff, honoring the Retry-After header. Requests are
+// rejected without being sent while breaker is open.
+type RetryTransport struct {
+	base    http.RoundTripper
+	breaker *CircuitBreaker
+
+	maxRetries    int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxRetryAfter time.Duration
+}
+
+var _ http.RoundTripper = (*RetryTransport)(nil)
+
+// base defaults to http.DefaultTransport. breaker may be nil.
+func NewRetryTransport(base http.RoundTripper, breaker *CircuitBreaker) *RetryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &RetryTransport{
+		base:    base,
+		breaker: breaker,
+
+		maxRetries:    defaultMaxRetries,
+		minBackoff:    defaultMinBackoff,
+		maxBackoff:    defaultMaxBackoff,
+		maxRetryAfter: defaultMaxRetryAfter,
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.breaker != nil {
+		if err := t.breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	res, retryable, err := t.roundTrip(req)
+
+	if t.breaker != nil {
+		switch {
+		// Shutdowns and abandoned polls say nothing about the api
+		case req.Context().Err() != nil:
+			t.breaker.Release()
+		// Includes rate limits that were still failing when retries ran out
+		case err != nil || retryable:
+			t.breaker.RecordFailure()
+		default:
+			t.breaker.RecordSuccess()
+		}
+	}
+
+	return res, err
+}
+
+// Also returns whether the final response is one that would have been retried,
+// such as a quota or server error that outlasted the retries.
+func (t *RetryTransport) roundTrip(req *http.Request) (*http.Response, bool, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && hasBody(req) {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, false, err
+			}
+
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		res, err := t.base.RoundTrip(req)
+
+		// Requests with a body that can't be replayed are never retried
+		canRetry := attempt < t.maxRetries && (!hasBody(req) || req.GetBody != nil)
+
+		if err != nil {
+			if !canRetry || req.Context().Err() != nil {
+				return nil, false, err
+			}
+
+			slog.Debug("retrying request after error", "url", req.URL.Redacted(), "attempt", attempt+1, "error", err)
+		} else {
+			retry, err := shouldRetry(res)
+			if err != nil {
+				res.Body.Close()
+				return nil, false, err
+			}
+
+			if !retry || !canRetry {
+				return res, retry, nil
+			}
+
+			wait := t.backoff(attempt)
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				if retryAfter > t.maxRetryAfter {
+					return res, true, nil
+				}
+
+				wait = retryAfter
+			}
+
+			// Discard the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(res.Body, maxRateLimitBodySize))
+			res.Body.Close()
+
+			slog.Debug("retrying request after quota or server error", "url", req.URL.Redacted(), "status", res.StatusCode, "attempt", attempt+1, "wait", wait)
+
+			if err := sleep(req, wait); err != nil {
+				return nil, false, err
+			}
+
+			continue
+		}
+
+		if err := sleep(req, t.backoff(attempt)); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// Full jitter: a random duration between 0 and the exponential backoff.
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	d := t.minBackoff << attempt
+	if d <= 0 || d > t.maxBackoff {
+		d = t.maxBackoff
+	}
+
+	return rand.N(d) + time.Millisecond
+}
+
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+func sleep(req *http.Request, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// 403 is retried only if the error reason is a rate limit. The body is read to
+// find out and replaced so the caller can still read it.
+func shouldRetry(res *http.Response) (bool, error) {
+	if isRetryableStatus(res.StatusCode) {
+		return true, nil
+	}
+
+	if res.StatusCode != http.StatusForbidden {
+		return false, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxRateLimitBodySize))
+	if err != nil {
+		return false, err
+	}
+
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), res.Body), res.Body}
+
+	return bytes.Contains(b, []byte(`"rateLimitExceeded"`)) || bytes.Contains(b, []byte(`"userRateLimitExceeded"`)), nil
+}
+
+// Retry-After is either a number of seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,86 @@
+package gworkspace
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRetryTransportBreaker(t *testing.T) {
+	tests := []struct {
+		name string
+		// Cancels the request context when it is sent if set
+		cancel    bool
+		status    int
+		wantState CircuitState
+	}{
+		{name: "canceled", cancel: true, wantState: CircuitState_Closed},
+		{name: "server error", status: http.StatusInternalServerError, wantState: CircuitState_Open},
+		{name: "success", status: http.StatusOK, wantState: CircuitState_Closed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := NewCircuitBreaker("test")
+			transport := NewRetryTransport(nil, breaker)
+			transport.maxRetries = 0
+
+			for range breaker.failureThreshold {
+				ctx, cancel := context.WithCancel(context.Background())
+
+				transport.base = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if tt.cancel {
+						cancel()
+						return nil, req.Context().Err()
+					}
+
+					return &http.Response{StatusCode: tt.status, Body: http.NoBody, Header: http.Header{}}, nil
+				})
+
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/", nil)
+				if res, err := transport.RoundTrip(req); err == nil {
+					res.Body.Close()
+				}
+
+				cancel()
+			}
+
+			if got := breaker.State(); got != tt.wantState {
+				t.Errorf("breaker state = %s, want %s", got, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestRetryTransportCanceledTrialReleasesBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker("test")
+	breaker.cooldown = 0
+	for range breaker.failureThreshold {
+		breaker.RecordFailure()
+	}
+
+	transport := NewRetryTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}), breaker)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/", nil)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip() succeeded, want the context error")
+	}
+
+	// The canceled trial must not block the next one
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("Allow() after a canceled trial = %v, want nil", err)
+	}
+}
@@ -0,0 +1,76 @@
+package gworkspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenInfoUrl = "https://oauth2.googleapis.com/tokeninfo"
+)
+
+// Returns the scopes from the token response, or fallback if the response did
+// not include them.
+func grantedScopes(tok *oauth2.Token, fallback []string) []string {
+	if s, ok := tok.Extra("scope").(string); ok && s != "" {
+		return strings.Fields(s)
+	}
+
+	return slices.Clone(fallback)
+}
+
+// Asks Google which scopes have been granted to the token from src.
+func lookupGrantedScopes(ctx context.Context, src oauth2.TokenSource) ([]string, error) {
+	tok, err := src.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenInfoUrl+"?access_token="+url.QueryEscape(tok.AccessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error while requesting token info: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token info responded with status %s", res.Status)
+	}
+
+	info := struct {
+		Scope string `json:"scope"`
+	}{}
+
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse token info: %v", err)
+	}
+
+	return strings.Fields(info.Scope), nil
+}
+
+// Returns the scopes in requested that are not in granted.
+func missingScopes(granted []string, requested []string) []string {
+	missing := make([]string, 0)
+	for _, s := range requested {
+		if !slices.Contains(granted, s) && !slices.Contains(missing, s) {
+			missing = append(missing, s)
+		}
+	}
+
+	return missing
+}
+
+func unionScopes(a []string, b []string) []string {
+	return append(slices.Clone(a), missingScopes(a, b)...)
+}
@@ -0,0 +1,310 @@
+package gworkspace
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/link00000000/gwsn/internal/atomicfile"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// Oauth token along with the scopes that were granted to it.
+type StoredToken struct {
+	oauth2.Token
+
+	// Empty for tokens whose scopes are not known, such as tokens seeded from the
+	// config or saved before scopes were tracked.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Persists the oauth token of a single account.
+type TokenStore interface {
+	// Returns ErrTokenNotFound if no token has been saved yet.
+	Load() (*StoredToken, error)
+	Save(tok *StoredToken) error
+}
+
+type TokenStoreType string
+
+const (
+	TokenStoreType_File          TokenStoreType = "file"
+	TokenStoreType_EncryptedFile TokenStoreType = "encryptedFile"
+	TokenStoreType_Keyring       TokenStoreType = "keyring"
+)
+
+// Stores the token as plain JSON.
+type FileTokenStore struct {
+	path string
+}
+
+var _ TokenStore = (*FileTokenStore)(nil)
+
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{
+		path: path,
+	}
+}
+
+func (s *FileTokenStore) Load() (*StoredToken, error) {
+	slog.Debug("loading token from file", "file", s.path)
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrTokenNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file (%s): %v", s.path, err)
+	}
+
+	tok := &StoredToken{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("failed to parse token file (%s): %v", s.path, err)
+	}
+
+	return tok, nil
+}
+
+func (s *FileTokenStore) Save(tok *StoredToken) error {
+	slog.Debug("saving token to file", "file", s.path)
+
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("failed to encode token: %v", err)
+	}
+
+	if err := atomicfile.WriteFile(s.path, b); err != nil {
+		return fmt.Errorf("failed to write token file (%s): %v", s.path, err)
+	}
+
+	return nil
+}
+
+// Stores the token encrypted with AES-GCM using a key derived from a passphrase
+// with scrypt.
+type EncryptedFileTokenStore struct {
+	path       string
+	passphrase []byte
+}
+
+var _ TokenStore = (*EncryptedFileTokenStore)(nil)
+
+type encryptedTokenFile struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func NewEncryptedFileTokenStore(path string, passphrase string) *EncryptedFileTokenStore {
+	return &EncryptedFileTokenStore{
+		path:       path,
+		passphrase: []byte(passphrase),
+	}
+}
+
+func (s *EncryptedFileTokenStore) Load() (*StoredToken, error) {
+	slog.Debug("loading token from encrypted file", "file", s.path)
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrTokenNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file (%s): %v", s.path, err)
+	}
+
+	f := encryptedTokenFile{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse token file (%s): %v", s.path, err)
+	}
+
+	aead, err := s.aead(f.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce in token file (%s)", s.path)
+	}
+
+	plaintext, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token file (%s), is the passphrase correct?: %v", s.path, err)
+	}
+
+	tok := &StoredToken{}
+	if err := json.Unmarshal(plaintext, tok); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted token (%s): %v", s.path, err)
+	}
+
+	return tok, nil
+}
+
+func (s *EncryptedFileTokenStore) Save(tok *StoredToken) error {
+	slog.Debug("saving token to encrypted file", "file", s.path)
+
+	plaintext, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("failed to encode token: %v", err)
+	}
+
+	f := encryptedTokenFile{
+		Salt: make([]byte, 16),
+	}
+
+	if _, err := rand.Read(f.Salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	aead, err := s.aead(f.Salt)
+	if err != nil {
+		return err
+	}
+
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	f.Ciphertext = aead.Seal(nil, f.Nonce, plaintext, nil)
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("failed to encode encrypted token: %v", err)
+	}
+
+	if err := atomicfile.WriteFile(s.path, b); err != nil {
+		return fmt.Errorf("failed to write token file (%s): %v", s.path, err)
+	}
+
+	return nil
+}
+
+func (s *EncryptedFileTokenStore) aead(salt []byte) (cipher.AEAD, error) {
+	if len(s.passphrase) == 0 {
+		return nil, errors.New("encrypted token store requires a passphrase")
+	}
+
+	// Recommended interactive parameters from the scrypt package documentation
+	key, err := scrypt.Key(s.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key from passphrase: %v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Stores the token in the platform keyring (Secret Service on Linux and BSD,
+// Keychain on macOS and Credential Manager on Windows).
+type KeyringTokenStore struct {
+	service string
+	user    string
+}
+
+var _ TokenStore = (*KeyringTokenStore)(nil)
+
+func NewKeyringTokenStore(service string, user string) *KeyringTokenStore {
+	return &KeyringTokenStore{
+		service: service,
+		user:    user,
+	}
+}
+
+func (s *KeyringTokenStore) Load() (*StoredToken, error) {
+	slog.Debug("loading token from keyring", "service", s.service, "user", s.user)
+
+	secret, err := keyring.Get(s.service, s.user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil, ErrTokenNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token from keyring: %v", err)
+	}
+
+	tok := &StoredToken{}
+	if err := json.Unmarshal([]byte(secret), tok); err != nil {
+		return nil, fmt.Errorf("failed to parse token from keyring: %v", err)
+	}
+
+	return tok, nil
+}
+
+func (s *KeyringTokenStore) Save(tok *StoredToken) error {
+	slog.Debug("saving token to keyring", "service", s.service, "user", s.user)
+
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("failed to encode token: %v", err)
+	}
+
+	if err := keyring.Set(s.service, s.user, string(b)); err != nil {
+		return fmt.Errorf("failed to write token to keyring: %v", err)
+	}
+
+	return nil
+}
+
+// Token source that saves every new token it hands out to a TokenStore, so that
+// tokens refreshed in the background survive a restart.
+type storingTokenSource struct {
+	mu    sync.Mutex
+	src   oauth2.TokenSource
+	store TokenStore
+	last  *StoredToken
+}
+
+var _ oauth2.TokenSource = (*storingTokenSource)(nil)
+
+func newStoringTokenSource(src oauth2.TokenSource, store TokenStore, initial *StoredToken) *storingTokenSource {
+	return &storingTokenSource{
+		src:   src,
+		store: store,
+		last:  initial,
+	}
+}
+
+func (s *storingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil || s.last.AccessToken != tok.AccessToken {
+		stored := &StoredToken{Token: *tok}
+		if s.last != nil {
+			// Refreshing never changes the granted scopes
+			stored.Scopes = s.last.Scopes
+		}
+
+		s.last = stored
+
+		if err := s.store.Save(stored); err != nil {
+			// The token is still usable, we will try again on the next refresh
+			slog.Error("failed to save refreshed token", "error", err)
+		}
+	}
+
+	return tok, nil
+}
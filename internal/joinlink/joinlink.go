@@ -0,0 +1,92 @@
+package joinlink
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type Provider string
+
+const (
+	Provider_Meet  Provider = "meet"
+	Provider_Zoom  Provider = "zoom"
+	Provider_Teams Provider = "teams"
+	Provider_Webex Provider = "webex"
+)
+
+type Link struct {
+	Provider Provider
+	Url      string
+}
+
+var (
+	// Candidate urls, validated by the provider patterns below. Stops at
+	// whitespace, quotes and brackets that surround urls in plain text and HTML.
+	urlPattern = regexp.MustCompile(`https?://[^\s"'<>()\[\]{}]+`)
+
+	providerPatterns = []struct {
+		provider Provider
+		pattern  *regexp.Regexp
+	}{
+		{Provider_Meet, regexp.MustCompile(`^https://meet\.google\.com/[a-z]{3}-[a-z]{4}-[a-z]{3}\b`)},
+		{Provider_Zoom, regexp.MustCompile(`^https://([a-z0-9-]+\.)?zoom(gov)?\.us/(j|my|w|s)/`)},
+		{Provider_Teams, regexp.MustCompile(`^https://teams\.(microsoft|live)\.com/(l/meetup-join|meet)/`)},
+		{Provider_Webex, regexp.MustCompile(`^https://([a-z0-9-]+\.)?webex\.com/(meet/|join/|[a-z0-9-]+/j\.php\?|wbxmjs/joinservice/)`)},
+	}
+)
+
+// Returns the first link to join a video meeting in texts, such as the location
+// and description of a calendar event, which are searched in order. Plain text
+// and HTML are both supported.
+func Find(texts ...string) (Link, bool) {
+	for _, text := range texts {
+		for _, candidate := range urlPattern.FindAllString(html.UnescapeString(text), -1) {
+			if link, ok := Parse(candidate); ok {
+				return link, true
+			}
+		}
+	}
+
+	return Link{}, false
+}
+
+// Returns the join link if rawUrl is one. Links wrapped in a Google redirect,
+// as in descriptions of events copied from emails, are unwrapped.
+func Parse(rawUrl string) (Link, bool) {
+	rawUrl = strings.TrimRight(rawUrl, ".,;:!?")
+
+	if target, ok := unwrapRedirect(rawUrl); ok {
+		rawUrl = target
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return Link{}, false
+	}
+
+	// Hosts are case-insensitive, paths and queries such as meeting passwords
+	// are not
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	normalized := u.String()
+
+	for _, p := range providerPatterns {
+		if p.pattern.MatchString(normalized) {
+			return Link{Provider: p.provider, Url: normalized}, true
+		}
+	}
+
+	return Link{}, false
+}
+
+func unwrapRedirect(rawUrl string) (string, bool) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || !strings.EqualFold(u.Host, "www.google.com") || u.Path != "/url" {
+		return "", false
+	}
+
+	target := u.Query().Get("q")
+	return target, target != ""
+}
@@ -0,0 +1,235 @@
+package joinlink
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		rawUrl string
+		want   Link
+		ok     bool
+	}{
+		{
+			name:   "meet",
+			rawUrl: "https://meet.google.com/abc-defg-hij",
+			want:   Link{Provider_Meet, "https://meet.google.com/abc-defg-hij"},
+			ok:     true,
+		},
+		{
+			name:   "meet with query",
+			rawUrl: "https://meet.google.com/abc-defg-hij?authuser=1",
+			want:   Link{Provider_Meet, "https://meet.google.com/abc-defg-hij?authuser=1"},
+			ok:     true,
+		},
+		{
+			name:   "meet landing page",
+			rawUrl: "https://meet.google.com/landing",
+		},
+		{
+			name:   "zoom",
+			rawUrl: "https://zoom.us/j/1234567890?pwd=AbC123",
+			want:   Link{Provider_Zoom, "https://zoom.us/j/1234567890?pwd=AbC123"},
+			ok:     true,
+		},
+		{
+			name:   "zoom vanity subdomain",
+			rawUrl: "https://acme-corp.zoom.us/j/1234567890",
+			want:   Link{Provider_Zoom, "https://acme-corp.zoom.us/j/1234567890"},
+			ok:     true,
+		},
+		{
+			name:   "zoomgov",
+			rawUrl: "https://agency.zoomgov.us/j/1234567890",
+			want:   Link{Provider_Zoom, "https://agency.zoomgov.us/j/1234567890"},
+			ok:     true,
+		},
+		{
+			name:   "zoom personal room",
+			rawUrl: "https://zoom.us/my/jdoe",
+			want:   Link{Provider_Zoom, "https://zoom.us/my/jdoe"},
+			ok:     true,
+		},
+		{
+			name:   "zoom marketing page",
+			rawUrl: "https://zoom.us/pricing",
+		},
+		{
+			name:   "teams meetup-join",
+			rawUrl: "https://teams.microsoft.com/l/meetup-join/19%3ameeting_abc%40thread.v2/0?context=%7b%7d",
+			want:   Link{Provider_Teams, "https://teams.microsoft.com/l/meetup-join/19%3ameeting_abc%40thread.v2/0?context=%7b%7d"},
+			ok:     true,
+		},
+		{
+			name:   "teams meet",
+			rawUrl: "https://teams.microsoft.com/meet/1234567890?p=AbCdEf",
+			want:   Link{Provider_Teams, "https://teams.microsoft.com/meet/1234567890?p=AbCdEf"},
+			ok:     true,
+		},
+		{
+			name:   "teams live",
+			rawUrl: "https://teams.live.com/meet/9876543210",
+			want:   Link{Provider_Teams, "https://teams.live.com/meet/9876543210"},
+			ok:     true,
+		},
+		{
+			name:   "teams chat",
+			rawUrl: "https://teams.microsoft.com/l/chat/0/0",
+		},
+		{
+			name:   "webex meet",
+			rawUrl: "https://acme.webex.com/meet/jdoe",
+			want:   Link{Provider_Webex, "https://acme.webex.com/meet/jdoe"},
+			ok:     true,
+		},
+		{
+			name:   "webex j.php",
+			rawUrl: "https://acme.webex.com/acme/j.php?MTID=m0123abc",
+			want:   Link{Provider_Webex, "https://acme.webex.com/acme/j.php?MTID=m0123abc"},
+			ok:     true,
+		},
+		{
+			name:   "webex joinservice",
+			rawUrl: "https://acme.webex.com/wbxmjs/joinservice/sites/acme/meeting/download/0123abc",
+			want:   Link{Provider_Webex, "https://acme.webex.com/wbxmjs/joinservice/sites/acme/meeting/download/0123abc"},
+			ok:     true,
+		},
+		{
+			name:   "webex home page",
+			rawUrl: "https://www.webex.com/downloads.html",
+		},
+		{
+			name:   "google redirect",
+			rawUrl: "https://www.google.com/url?q=https%3A%2F%2Fzoom.us%2Fj%2F1234567890%3Fpwd%3DAbC&sa=D&source=calendar",
+			want:   Link{Provider_Zoom, "https://zoom.us/j/1234567890?pwd=AbC"},
+			ok:     true,
+		},
+		{
+			name:   "google redirect to other site",
+			rawUrl: "https://www.google.com/url?q=https%3A%2F%2Fexample.com%2F",
+		},
+		{
+			name:   "trailing punctuation",
+			rawUrl: "https://meet.google.com/abc-defg-hij?!",
+			want:   Link{Provider_Meet, "https://meet.google.com/abc-defg-hij"},
+			ok:     true,
+		},
+		{
+			name:   "trailing period",
+			rawUrl: "https://zoom.us/j/1234567890.",
+			want:   Link{Provider_Zoom, "https://zoom.us/j/1234567890"},
+			ok:     true,
+		},
+		{
+			name:   "uppercase host",
+			rawUrl: "HTTPS://ACME.ZOOM.US/j/1234567890?pwd=AbC123",
+			want:   Link{Provider_Zoom, "https://acme.zoom.us/j/1234567890?pwd=AbC123"},
+			ok:     true,
+		},
+		{
+			name:   "uppercase path",
+			rawUrl: "https://zoom.us/J/1234567890",
+		},
+		{
+			name:   "plain http",
+			rawUrl: "http://meet.google.com/abc-defg-hij",
+		},
+		{
+			name:   "lookalike host",
+			rawUrl: "https://meet.google.com.example.com/abc-defg-hij",
+		},
+		{
+			name:   "not a url",
+			rawUrl: "Conference room 4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Parse(tt.rawUrl)
+			if !tt.ok {
+				if ok {
+					t.Errorf("Parse(%q) = %+v, want no link", tt.rawUrl, got)
+				}
+				return
+			}
+
+			if !ok || got != tt.want {
+				t.Errorf("Parse(%q) = %+v, %v, want %+v", tt.rawUrl, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		name  string
+		texts []string
+		want  Link
+		ok    bool
+	}{
+		{
+			name:  "plain text",
+			texts: []string{"Join at https://meet.google.com/abc-defg-hij, or dial in."},
+			want:  Link{Provider_Meet, "https://meet.google.com/abc-defg-hij"},
+			ok:    true,
+		},
+		{
+			name:  "parenthesized",
+			texts: []string{"Video call (https://zoom.us/j/1234567890)."},
+			want:  Link{Provider_Zoom, "https://zoom.us/j/1234567890"},
+			ok:    true,
+		},
+		{
+			name:  "html escaped query",
+			texts: []string{`<a href="https://acme.webex.com/acme/j.php?MTID=m0123abc&amp;from=calendar">Join</a>`},
+			want:  Link{Provider_Webex, "https://acme.webex.com/acme/j.php?MTID=m0123abc&from=calendar"},
+			ok:    true,
+		},
+		{
+			name:  "html google redirect",
+			texts: []string{`<a href="https://www.google.com/url?q=https://teams.microsoft.com/meet/1234567890?p%3DAbC&amp;sa=D">Join</a>`},
+			want:  Link{Provider_Teams, "https://teams.microsoft.com/meet/1234567890?p=AbC"},
+			ok:    true,
+		},
+		{
+			name:  "skips other urls",
+			texts: []string{"Agenda: https://docs.google.com/document/d/abc Join: https://zoom.us/j/1234567890"},
+			want:  Link{Provider_Zoom, "https://zoom.us/j/1234567890"},
+			ok:    true,
+		},
+		{
+			name: "location before description",
+			texts: []string{
+				"https://teams.microsoft.com/meet/1234567890",
+				"Join Zoom meeting https://zoom.us/j/1234567890",
+			},
+			want: Link{Provider_Teams, "https://teams.microsoft.com/meet/1234567890"},
+			ok:   true,
+		},
+		{
+			name: "description when location has none",
+			texts: []string{
+				"Conference room 4",
+				"Join Zoom meeting https://zoom.us/j/1234567890",
+			},
+			want: Link{Provider_Zoom, "https://zoom.us/j/1234567890"},
+			ok:   true,
+		},
+		{
+			name:  "no meeting",
+			texts: []string{"Lunch", "See https://example.com/menu"},
+		},
+		{
+			name: "no texts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Find(tt.texts...)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("Find(%q) = %+v, %v, want %+v, %v", tt.texts, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package rules
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+type ActionType string
+
+const (
+	ActionType_Notify ActionType = "notify"
+	ActionType_Mute   ActionType = "mute"
+)
+
+// Conditions a message must meet for a rule to apply. Empty conditions are
+// ignored, every set condition must match.
+type Match struct {
+	// Case-insensitive substrings of the display name or address, such as
+	// "alice@example.com" or "@example.com". At least one must match.
+	From []string
+	To   []string
+	Cc   []string
+
+	// Regular expression matched against the subject
+	Subject string
+
+	// Label ids or names, such as IMPORTANT, CATEGORY_SOCIAL or Work/Urgent. At
+	// least one must be on the message. Names only match once resolved with
+	// RuleSet.ResolveLabels.
+	Labels []string
+
+	// Case-insensitive substring of the List-Id header
+	ListId string
+
+	HasAttachments *bool
+}
+
+type Action struct {
+	// Defaults to ActionType_Notify
+	Type ActionType
+
+	Urgent bool
+	Sound  services.NotificationSound
+	// Raw image data, replaces the default icon
+	Icon []byte
+	// Name of the notification sink to send to. Empty for the notification
+	// service.
+	Sink string
+}
+
+type Rule struct {
+	Name   string
+	Match  Match
+	Action Action
+}
+
+type compiledRule struct {
+	Rule
+	subject *regexp.Regexp
+	// Ids of Match.Labels
+	labelIds []string
+}
+
+// Ordered list of rules where the first matching rule decides what happens to
+// a message.
+type RuleSet struct {
+	rules []*compiledRule
+}
+
+// Creates a rule set from the concatenation of ruleLists, in order.
+func NewRuleSet(ruleLists ...[]Rule) (*RuleSet, error) {
+	rs := &RuleSet{
+		rules: make([]*compiledRule, 0),
+	}
+
+	for _, rule := range slices.Concat(ruleLists...) {
+		cr := &compiledRule{Rule: rule, labelIds: rule.Match.Labels}
+
+		if rule.Match.Subject != "" {
+			re, err := regexp.Compile(rule.Match.Subject)
+			if err != nil {
+				return nil, fmt.Errorf("invalid subject pattern in rule %s: %v", rule.Name, err)
+			}
+
+			cr.subject = re
+		}
+
+		switch rule.Action.Type {
+		case "", ActionType_Notify, ActionType_Mute:
+		default:
+			return nil, fmt.Errorf("unknown action type in rule %s: %s", rule.Name, rule.Action.Type)
+		}
+
+		if !rule.Action.Sound.IsValid() {
+			return nil, fmt.Errorf("unknown sound in rule %s: %s", rule.Name, rule.Action.Sound)
+		}
+
+		rs.rules = append(rs.rules, cr)
+	}
+
+	return rs, nil
+}
+
+// Returns a copy of the rule set with the label names of its rules resolved to
+// the ids of labels. Rules none of whose labels exist never match.
+func (rs *RuleSet) ResolveLabels(labels *gworkspace.GmailLabels) *RuleSet {
+	resolved := &RuleSet{
+		rules: make([]*compiledRule, len(rs.rules)),
+	}
+
+	for i, r := range rs.rules {
+		cr := *r
+		cr.labelIds = labels.Ids(r.Match.Labels)
+		resolved.rules[i] = &cr
+	}
+
+	return resolved
+}
+
+// Returns the rule that applies to msg, or nil if no rule matches.
+func (rs *RuleSet) Evaluate(msg *gworkspace.GmailMessage) *Rule {
+	for _, r := range rs.rules {
+		if r.matches(msg) {
+			return &r.Rule
+		}
+	}
+
+	return nil
+}
+
+// Returns the action of the rule that applies to msg, or a plain notify action
+// if no rule matches.
+func (rs *RuleSet) Action(msg *gworkspace.GmailMessage) Action {
+	if r := rs.Evaluate(msg); r != nil {
+		action := r.Action
+		if action.Type == "" {
+			action.Type = ActionType_Notify
+		}
+
+		return action
+	}
+
+	return Action{Type: ActionType_Notify}
+}
+
+func (r *compiledRule) matches(msg *gworkspace.GmailMessage) bool {
+	m := r.Match
+
+	if len(m.From) > 0 && (msg.From == nil || !addressMatches(msg.From, m.From)) {
+		return false
+	}
+
+	if len(m.To) > 0 && !slices.ContainsFunc(msg.To, func(a *mail.Address) bool { return addressMatches(a, m.To) }) {
+		return false
+	}
+
+	if len(m.Cc) > 0 && !slices.ContainsFunc(msg.Cc, func(a *mail.Address) bool { return addressMatches(a, m.Cc) }) {
+		return false
+	}
+
+	if r.subject != nil && !r.subject.MatchString(msg.Subject) {
+		return false
+	}
+
+	if len(m.Labels) > 0 && !slices.ContainsFunc(r.labelIds, func(l string) bool { return slices.Contains(msg.LabelIds, l) }) {
+		return false
+	}
+
+	if m.ListId != "" && !containsAnyFold(msg.ListId, []string{m.ListId}) {
+		return false
+	}
+
+	if m.HasAttachments != nil && *m.HasAttachments != msg.HasAttachments {
+		return false
+	}
+
+	return true
+}
+
+func addressMatches(addr *mail.Address, substrs []string) bool {
+	return containsAnyFold(addr.Name, substrs) || containsAnyFold(addr.Address, substrs)
+}
+
+func containsAnyFold(s string, substrs []string) bool {
+	s = strings.ToLower(s)
+
+	for _, sub := range substrs {
+		if strings.Contains(s, strings.ToLower(sub)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestRuleSetResolveLabels(t *testing.T) {
+	labels := gworkspace.NewGmailLabels([]*gmail.Label{
+		{Id: "INBOX", Name: "INBOX"},
+		{Id: "IMPORTANT", Name: "IMPORTANT"},
+		{Id: "Label_7", Name: "Work/Urgent"},
+	})
+
+	rs, err := NewRuleSet([]Rule{
+		{Name: "missing", Match: Match{Labels: []string{"Does not exist"}}, Action: Action{Urgent: true}},
+		{Name: "urgent", Match: Match{Labels: []string{"work/urgent"}}, Action: Action{Urgent: true}},
+		{Name: "important", Match: Match{Labels: []string{"IMPORTANT"}}, Action: Action{Sound: "alert"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+
+	resolved := rs.ResolveLabels(labels)
+
+	tests := []struct {
+		name     string
+		labelIds []string
+		// Name of the matching rule, empty for none
+		want string
+		// Matching rule before resolving, since names don't match ids
+		wantUnresolved string
+	}{
+		{name: "by name", labelIds: []string{"INBOX", "Label_7"}, want: "urgent"},
+		{name: "by id", labelIds: []string{"INBOX", "IMPORTANT"}, want: "important", wantUnresolved: "important"},
+		{name: "no labels", labelIds: []string{"INBOX"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &gworkspace.GmailMessage{Id: "m1", LabelIds: tt.labelIds}
+
+			if got := ruleName(resolved.Evaluate(msg)); got != tt.want {
+				t.Errorf("resolved Evaluate() = %q, want %q", got, tt.want)
+			}
+
+			if got := ruleName(rs.Evaluate(msg)); got != tt.wantUnresolved {
+				t.Errorf("unresolved Evaluate() = %q, want %q", got, tt.wantUnresolved)
+			}
+		})
+	}
+}
+
+func ruleName(r *Rule) string {
+	if r == nil {
+		return ""
+	}
+
+	return r.Name
+}
@@ -0,0 +1,232 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/state"
+	gmailapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Action that can be taken on the messages of a notification.
+type MessageAction string
+
+const (
+	MessageAction_MarkRead MessageAction = "markRead"
+	MessageAction_Archive  MessageAction = "archive"
+	MessageAction_Star     MessageAction = "star"
+	MessageAction_Trash    MessageAction = "trash"
+)
+
+func (a MessageAction) Label() string {
+	switch a {
+	case MessageAction_MarkRead:
+		return "Mark as read"
+	case MessageAction_Archive:
+		return "Archive"
+	case MessageAction_Star:
+		return "Star"
+	case MessageAction_Trash:
+		return "Delete"
+	default:
+		return string(a)
+	}
+}
+
+func (a MessageAction) IsValid() bool {
+	switch a {
+	case MessageAction_MarkRead, MessageAction_Archive, MessageAction_Star, MessageAction_Trash:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	minActionRetryInterval = time.Second * 30
+	maxActionRetryInterval = time.Minute * 10
+)
+
+type pendingMessageAction struct {
+	Action     MessageAction `json:"action"`
+	MessageIds []string      `json:"messageIds"`
+}
+
+// Applies message actions in the order they were picked. Actions that fail
+// because gmail can't be reached are kept, persisted, and retried with backoff
+// until they succeed.
+type messageActionQueue struct {
+	svc      *gmailapi.Service
+	state    state.Store
+	stateKey string
+
+	mu      sync.Mutex
+	pending []pendingMessageAction
+	wake    chan struct{}
+}
+
+// store may be nil, in which case pending actions are lost on exit.
+func newMessageActionQueue(svc *gmailapi.Service, store state.Store, stateKey string) *messageActionQueue {
+	q := &messageActionQueue{
+		svc:      svc,
+		state:    store,
+		stateKey: stateKey,
+		pending:  make([]pendingMessageAction, 0),
+		wake:     make(chan struct{}, 1),
+	}
+
+	if store != nil {
+		if _, err := store.Load(stateKey, &q.pending); err != nil {
+			app.Logger().Warn("failed to restore pending gmail actions", "key", stateKey, "error", err)
+		}
+	}
+
+	return q
+}
+
+func (q *messageActionQueue) enqueue(action MessageAction, msgIds []string) {
+	q.mu.Lock()
+	q.pending = append(q.pending, pendingMessageAction{Action: action, MessageIds: msgIds})
+	q.saveState()
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Applies pending actions until ctx is cancelled.
+func (q *messageActionQueue) run(ctx context.Context) error {
+	retryInterval := minActionRetryInterval
+
+	for {
+		// Blocks forever unless there is something to retry
+		var wait <-chan time.Time
+
+		if q.flush(ctx) {
+			retryInterval = minActionRetryInterval
+		} else {
+			app.Logger().Info("failed to apply gmail actions, retrying later", "key", q.stateKey, "interval", retryInterval)
+
+			wait = time.After(retryInterval)
+			retryInterval = min(retryInterval*2, maxActionRetryInterval)
+		}
+
+		select {
+		case <-q.wake:
+		case <-wait:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Applies actions until the queue is empty or one fails with an error worth
+// retrying. Returns false in the latter case.
+func (q *messageActionQueue) flush(ctx context.Context) bool {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return true
+		}
+
+		next := q.pending[0]
+		q.mu.Unlock()
+
+		done, err := q.apply(ctx, next)
+
+		q.mu.Lock()
+		if err == nil || !isRetryable(err) {
+			if err != nil {
+				app.Logger().Error("failed to apply gmail action, dropping it", "action", next.Action, "messageIds", next.MessageIds, "error", err)
+			}
+
+			q.pending = slices.Delete(q.pending, 0, 1)
+		} else {
+			// Messages that were already handled are not tried again
+			q.pending[0].MessageIds = slices.DeleteFunc(slices.Clone(next.MessageIds), func(id string) bool {
+				return slices.Contains(done, id)
+			})
+		}
+
+		q.saveState()
+		q.mu.Unlock()
+
+		if err != nil && isRetryable(err) {
+			app.Logger().Warn("failed to apply gmail action", "action", next.Action, "error", err)
+			return false
+		}
+	}
+}
+
+// Returns the ids of the messages the action was applied to.
+func (q *messageActionQueue) apply(ctx context.Context, a pendingMessageAction) ([]string, error) {
+	app.Logger().Debug("applying gmail action", "action", a.Action, "messageIds", a.MessageIds)
+
+	modify := &gmailapi.BatchModifyMessagesRequest{Ids: a.MessageIds}
+
+	switch a.Action {
+	case MessageAction_MarkRead:
+		modify.RemoveLabelIds = []string{"UNREAD"}
+	case MessageAction_Archive:
+		modify.RemoveLabelIds = []string{"INBOX"}
+	case MessageAction_Star:
+		modify.AddLabelIds = []string{"STARRED"}
+	case MessageAction_Trash:
+		done := make([]string, 0, len(a.MessageIds))
+		for _, id := range a.MessageIds {
+			if _, err := q.svc.Users.Messages.Trash("me", id).Context(ctx).Do(); err != nil {
+				return done, err
+			}
+
+			done = append(done, id)
+		}
+
+		return done, nil
+	default:
+		return nil, fmt.Errorf("unknown gmail action: %s", a.Action)
+	}
+
+	if err := q.svc.Users.Messages.BatchModify("me", modify).Context(ctx).Do(); err != nil {
+		return nil, err
+	}
+
+	return a.MessageIds, nil
+}
+
+func (q *messageActionQueue) saveState() {
+	if q.state == nil {
+		return
+	}
+
+	if err := q.state.Save(q.stateKey, q.pending); err != nil {
+		app.Logger().Error("failed to save pending gmail actions", "key", q.stateKey, "error", err)
+	}
+}
+
+// Errors from gmail rejecting the request are not worth retrying, anything
+// else (no network, quota, server errors) is. Quota and server errors have
+// already been retried by the transport, but may well succeed later.
+func isRetryable(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return true
+	}
+
+	if gerr.Code == http.StatusTooManyRequests || gerr.Code >= http.StatusInternalServerError {
+		return true
+	}
+
+	return slices.ContainsFunc(gerr.Errors, func(item googleapi.ErrorItem) bool {
+		return item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded"
+	})
+}
@@ -0,0 +1,145 @@
+package gmail
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/rules"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+const (
+	// Number of senders named in a digest, the rest are counted together
+	maxDigestSenders = 3
+)
+
+type DigestOptions struct {
+	// How long messages are collected after the first one arrives
+	Window time.Duration
+	// Sends the digest early once this many messages were collected. 0 for no
+	// limit.
+	MaxMessages int
+}
+
+// Collects messages to be summarized in a single notification. Not safe for
+// concurrent use.
+type digest struct {
+	opts DigestOptions
+	msgs []threadMessage
+	// When the first collected message arrived
+	started time.Time
+}
+
+func newDigest(opts DigestOptions) *digest {
+	return &digest{
+		opts: opts,
+		msgs: make([]threadMessage, 0),
+	}
+}
+
+// Collects messages. Returns true once the digest is full and should be sent.
+func (d *digest) add(now time.Time, msgs []*gworkspace.GmailMessage, actions []rules.Action) bool {
+	if len(d.msgs) == 0 && len(msgs) > 0 {
+		d.started = now
+	}
+
+	for i, msg := range msgs {
+		d.msgs = append(d.msgs, threadMessage{msg: msg, action: actions[i]})
+	}
+
+	return d.opts.MaxMessages > 0 && len(d.msgs) >= d.opts.MaxMessages
+}
+
+// Drops messages that no longer need to be reported.
+func (d *digest) remove(msgIds []string) {
+	d.msgs = slices.DeleteFunc(d.msgs, func(m threadMessage) bool {
+		return slices.Contains(msgIds, m.msg.Id)
+	})
+}
+
+// When the digest is due, zero if there is nothing collected.
+func (d *digest) due() time.Time {
+	if len(d.msgs) == 0 {
+		return time.Time{}
+	}
+
+	return d.started.Add(d.opts.Window)
+}
+
+// Returns the collected messages and starts over. The returned slice is empty
+// if there was nothing collected.
+func (d *digest) take() []threadMessage {
+	msgs := d.msgs
+	d.msgs = make([]threadMessage, 0)
+
+	return msgs
+}
+
+// Builds the notification summarizing msgs, such as "7 new messages" with
+// "3 from Alice, 2 from Bob and 2 from others". msgs must not be empty.
+func digestNotification(key string, msgs []threadMessage, actions []services.NotificationAction) *services.Notification {
+	type senderCount struct {
+		name  string
+		count int
+	}
+
+	senders := make([]senderCount, 0)
+	for _, m := range msgs {
+		name := m.msg.Sender()
+		if name == "" {
+			name = "Unknown sender"
+		}
+
+		if i := slices.IndexFunc(senders, func(s senderCount) bool { return s.name == name }); i != -1 {
+			senders[i].count++
+		} else {
+			senders = append(senders, senderCount{name: name, count: 1})
+		}
+	}
+
+	// Stable, so that senders with the same count stay in the order they wrote
+	slices.SortStableFunc(senders, func(a, b senderCount) int { return cmp.Compare(b.count, a.count) })
+
+	parts := make([]string, 0, maxDigestSenders+1)
+	for _, s := range senders[:min(len(senders), maxDigestSenders)] {
+		parts = append(parts, fmt.Sprintf("%d from %s", s.count, s.name))
+	}
+
+	if len(senders) > maxDigestSenders {
+		others := 0
+		for _, s := range senders[maxDigestSenders:] {
+			others += s.count
+		}
+
+		parts = append(parts, fmt.Sprintf("%d from others", others))
+	}
+
+	body := parts[0]
+	if len(parts) > 1 {
+		body = strings.Join(parts[:len(parts)-1], ", ") + " and " + parts[len(parts)-1]
+	}
+
+	title := "1 new message"
+	if len(msgs) != 1 {
+		title = fmt.Sprintf("%d new messages", len(msgs))
+	}
+
+	latest := slices.MaxFunc(msgs, func(a, b threadMessage) int { return a.msg.InternalDate.Compare(b.msg.InternalDate) })
+
+	return &services.Notification{
+		Key:     key,
+		Title:   title,
+		Body:    body,
+		Icon:    latest.action.Icon,
+		Urgent:  slices.ContainsFunc(msgs, func(m threadMessage) bool { return m.action.Urgent }),
+		Sound:   latest.action.Sound,
+		Actions: actions,
+		// So that a VIP message is not held back with the rest of the digest
+		Senders: senderAddresses(msgs),
+		Labels:  labelIds(msgs),
+	}
+}
@@ -2,35 +2,91 @@ package gmail
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/browser"
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/rules"
 	"github.com/link00000000/gwsn/internal/services"
+	"github.com/link00000000/gwsn/internal/state"
+	"golang.org/x/sync/errgroup"
+	gmailapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
 )
 
-type AccountCredentials struct {
-	TokenType    string
-	AccessToken  string
-	RefreshToken string
-	Expiry       string
-	ExpiresIn    int
+type Account struct {
+	Name string
+	// May be shared with other services using the same account
+	Client *gworkspace.HttpClient
+	Labels gworkspace.GmailLabelFilter
+	// Decide which messages notify and how, first match wins. Label names are
+	// resolved against the account's labels when it starts. nil for no rules.
+	Rules *rules.RuleSet
+	// Summarizes messages in one notification instead of notifying each thread.
+	// nil to disable.
+	Digest *DigestOptions
+	// Whether the calendar service watches the account. Invitation emails are
+	// then left to it.
+	HasCalendar bool
 }
 
-type Account struct {
-	Name  string
-	Creds AccountCredentials
+type Options struct {
+	PollingInterval time.Duration
+
+	// Maximum number of notifications for messages received in a single poll.
+	// 0 for no limit.
+	MaxCatchUpMessages int
+
+	BatchSize             int
+	MaxConcurrentRequests int
+
+	// New messages of a thread that arrive within this long of the previous one
+	// update its notification instead of sending a new one. 0 only groups the
+	// messages of a single poll.
+	ThreadCoalesceWindow time.Duration
+
+	// Persists the sync position of each account between runs. May be nil.
+	State state.Store
+
+	// Buttons shown on notifications. Requires the gmail.modify scope.
+	NotificationActions []MessageAction
+
+	// Opens messages when a notification is clicked. Defaults to the system
+	// browser.
+	UrlOpener browser.Opener
 }
 
+const (
+	minAccountRetryInterval = time.Second * 30
+	maxAccountRetryInterval = time.Minute * 15
+)
+
 type gmailService struct {
-	pollingInterval time.Duration
-	accounts        []Account
+	opts     Options
+	accounts []Account
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 var _ services.GmailService = (*gmailService)(nil)
 
-func NewService(pollingInterval time.Duration, accounts []Account) *gmailService {
+func NewService(opts Options, accounts []Account) *gmailService {
+	if opts.UrlOpener == nil {
+		opts.UrlOpener = browser.System
+	}
+
 	return &gmailService{
-		pollingInterval: pollingInterval,
-		accounts:        accounts,
+		opts:     opts,
+		accounts: accounts,
 	}
 }
 
@@ -38,10 +94,414 @@ func (*gmailService) Setup() error {
 	return nil
 }
 
-func (*gmailService) Run(ctx context.Context) error {
+func (svc *gmailService) Scopes(account string) []string {
+	if !slices.ContainsFunc(svc.accounts, func(acc Account) bool { return acc.Name == account }) {
+		return nil
+	}
+
+	if len(svc.opts.NotificationActions) > 0 {
+		return []string{gmailapi.GmailModifyScope}
+	}
+
+	return []string{gmailapi.GmailReadonlyScope}
+}
+
+// Starts one GmailMonitor per configured account and forwards every new message
+// to the registered notification service. Blocks until ctx is cancelled or
+// Shutdown is called.
+func (svc *gmailService) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	svc.mu.Lock()
+	svc.cancel = cancel
+	svc.done = make(chan struct{})
+	done := svc.done
+	svc.mu.Unlock()
+
+	defer close(done)
+
+	// Accounts run independently, one that can't be reached or is no longer
+	// authorized does not stop the others
+	var wg sync.WaitGroup
+
+	for _, acc := range svc.accounts {
+		acc.Client.CircuitBreaker().OnStateChange(func(state gworkspace.CircuitState) {
+			app.SystemTrayService().SetServiceDegraded("Gmail ("+acc.Name+")", state != gworkspace.CircuitState_Closed)
+		})
+
+		// Subscribed once, so that restarts of the account don't pile up
+		// subscriptions
+		actionEvents := app.NotificationService().SubscribeActions(fmt.Sprintf("gmail/%s/", acc.Name))
+
+		wg.Go(func() { svc.superviseAccount(ctx, acc, actionEvents) })
+	}
+
+	wg.Wait()
+
 	return nil
 }
 
-func (*gmailService) Shutdown() error {
+// Stops all running monitors and waits for them to exit.
+func (svc *gmailService) Shutdown() error {
+	svc.mu.Lock()
+	cancel, done := svc.cancel, svc.done
+	svc.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	<-done
+
 	return nil
 }
+
+// Runs the account until ctx is cancelled, restarting it with backoff whenever
+// it fails, such as when starting offline or after the token was revoked.
+func (svc *gmailService) superviseAccount(ctx context.Context, acc Account, actionEvents <-chan services.NotificationActionEvent) {
+	retryInterval := minAccountRetryInterval
+
+	for {
+		started := time.Now()
+		err := svc.runAccount(ctx, acc, actionEvents)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Failures after a long healthy run start over with a short interval
+		if time.Since(started) > maxAccountRetryInterval {
+			retryInterval = minAccountRetryInterval
+		}
+
+		app.Logger().Error("gmail account stopped, restarting later", "account", acc.Name, "interval", retryInterval, "error", err)
+
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		retryInterval = min(retryInterval*2, maxAccountRetryInterval)
+	}
+}
+
+func (svc *gmailService) runAccount(ctx context.Context, acc Account, actionEvents <-chan services.NotificationActionEvent) error {
+	gsvc, client, err := svc.newApiService(ctx, acc)
+	if err != nil {
+		return fmt.Errorf("failed to create gmail api service for account %s: %v", acc.Name, err)
+	}
+
+	// The web client picks the account by address, indexes depend on the order
+	// the user signed in to their accounts in the browser
+	profile, err := gsvc.Users.GetProfile("me").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get gmail profile for account %s: %v", acc.Name, err)
+	}
+
+	monitor := gworkspace.NewGmailMonitor(gsvc, gworkspace.GmailMonitorOptions{
+		UpdateFreq:            svc.opts.PollingInterval,
+		State:                 svc.opts.State,
+		StateKey:              "gmail/" + acc.Name,
+		Labels:                acc.Labels,
+		MaxMessagesPerCheck:   svc.opts.MaxCatchUpMessages,
+		HttpClient:            client,
+		BatchSize:             svc.opts.BatchSize,
+		MaxConcurrentRequests: svc.opts.MaxConcurrentRequests,
+	})
+
+	if err := monitor.Initialize(ctx); err != nil {
+		return fmt.Errorf("failed to initialize gmail monitor for account %s: %v", acc.Name, err)
+	}
+
+	ruleSet := &rules.RuleSet{}
+	if acc.Rules != nil {
+		// Labels are matched by id, rules may name them like the label filter
+		ruleSet = acc.Rules.ResolveLabels(monitor.Labels())
+	}
+
+	r := &accountRunner{
+		opts:      svc.opts,
+		acc:       acc,
+		email:     profile.EmailAddress,
+		ruleSet:   ruleSet,
+		coalescer: newThreadCoalescer(fmt.Sprintf("gmail/%s/thread/", acc.Name), svc.opts.ThreadCoalesceWindow),
+		gsvc:      gsvc,
+		actions:   newMessageActionQueue(gsvc, svc.opts.State, "gmail/"+acc.Name+"/actions"),
+	}
+
+	if acc.Digest != nil {
+		r.digest = newDigest(*acc.Digest)
+	}
+
+	// Coalesced, so a slow notification backend can't make us lose messages
+	sub := monitor.Subscribe(gworkspace.GmailSubscribeOptions{Overflow: gworkspace.GmailOverflowPolicy_Coalesce})
+	defer monitor.Unsubscribe(sub)
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error { return monitor.Watch(ctx) })
+	g.Go(func() error { return r.actions.run(ctx) })
+	g.Go(func() error {
+		for {
+			// Blocks forever unless a digest is being collected
+			var digestDue <-chan time.Time
+			if r.digest != nil {
+				if due := r.digest.due(); !due.IsZero() {
+					digestDue = time.After(time.Until(due))
+				}
+			}
+
+			select {
+			case ev := <-sub.Events():
+				r.retract(ev.RemovedMessageIds)
+				r.notify(ctx, ev.Messages)
+
+			case ev := <-actionEvents:
+				r.handleAction(ev)
+
+			case <-digestDue:
+				r.sendDigest()
+
+			case <-ctx.Done():
+				// Collected messages would otherwise never be reported, since they
+				// are already past the saved history id
+				r.sendDigest()
+				return nil
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+// Returns the gmail service along with the authorized http client it uses.
+func (svc *gmailService) newApiService(ctx context.Context, acc Account) (*gmailapi.Service, *http.Client, error) {
+	if err := acc.Client.Configure(ctx, app.GoogleScopes(acc.Name)...); err != nil {
+		return nil, nil, fmt.Errorf("failed to configure http client: %v", err)
+	}
+
+	gsvc, err := gmailapi.NewService(ctx, option.WithHTTPClient(acc.Client.Client))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create gmail api service: %v", err)
+	}
+
+	return gsvc, acc.Client.Client, nil
+}
+
+// Turns the messages of a single account into notifications.
+type accountRunner struct {
+	opts    Options
+	acc     Account
+	gsvc    *gmailapi.Service
+	email   string
+	ruleSet *rules.RuleSet
+
+	coalescer *threadCoalescer
+	// nil unless the account is in digest mode
+	digest  *digest
+	actions *messageActionQueue
+}
+
+func (r *accountRunner) notify(ctx context.Context, msgs []*gworkspace.GmailMessage) {
+	notifyMsgs := make([]*gworkspace.GmailMessage, 0, len(msgs))
+	actions := make([]rules.Action, 0, len(msgs))
+
+	for _, msg := range msgs {
+		action := r.ruleSet.Action(msg)
+		if action.Type == rules.ActionType_Mute {
+			app.Logger().Debug("gmail notification muted by rule", "account", r.acc.Name, "messageId", msg.Id, "subject", msg.Subject)
+			continue
+		}
+
+		// The calendar service notifies invitations with RSVP actions
+		if r.isCalendarInvitation(ctx, msg) {
+			app.Logger().Debug("gmail notification of calendar invitation suppressed", "account", r.acc.Name, "messageId", msg.Id, "subject", msg.Subject)
+			continue
+		}
+
+		notifyMsgs = append(notifyMsgs, msg)
+		actions = append(actions, action)
+	}
+
+	if r.digest != nil {
+		if r.digest.add(time.Now(), notifyMsgs, actions) {
+			r.sendDigest()
+		}
+
+		return
+	}
+
+	for _, thread := range r.coalescer.add(time.Now(), notifyMsgs, actions) {
+		action := thread.latest().action
+		thread.sink = action.Sink
+
+		app.Logger().Debug("sending gmail notification", "account", r.acc.Name, "threadId", thread.threadId, "messages", len(thread.msgs), "subject", thread.subject, "sink", action.Sink)
+
+		sink(action.Sink).Send(thread.notification(action.Sound, r.notificationActions()))
+	}
+}
+
+func (r *accountRunner) isCalendarInvitation(ctx context.Context, msg *gworkspace.GmailMessage) bool {
+	if !r.acc.HasCalendar {
+		return false
+	}
+
+	email := services.InvitationEmail{Subject: msg.Subject}
+	if msg.From != nil {
+		email.FromAddress = msg.From.Address
+	}
+
+	// Invitations come with the event as an attachment
+	if msg.HasAttachments {
+		invite, err := gworkspace.FetchGmailCalendarInvite(ctx, r.gsvc, msg.Id)
+		if err != nil {
+			app.Logger().Warn("failed to look for a calendar invitation in gmail message", "account", r.acc.Name, "messageId", msg.Id, "error", err)
+		} else if invite != nil {
+			// Cancellations and replies are still worth a notification
+			if invite.Method != "" && invite.Method != "REQUEST" {
+				return false
+			}
+
+			email.ICalUID = invite.UID
+		}
+	}
+
+	return app.GoogleCalendarService().IsPendingInvitation(ctx, r.acc.Name, email)
+}
+
+func (r *accountRunner) sendDigest() {
+	if r.digest == nil {
+		return
+	}
+
+	msgs := r.digest.take()
+	if len(msgs) == 0 {
+		return
+	}
+
+	n := digestNotification(
+		fmt.Sprintf("gmail/%s/digest/%d", r.acc.Name, time.Now().UnixMilli()),
+		msgs,
+		[]services.NotificationAction{{Id: services.NotificationActionId_Default, Label: "Open"}},
+	)
+
+	sinkName := msgs[len(msgs)-1].action.Sink
+	app.Logger().Debug("sending gmail digest", "account", r.acc.Name, "messages", len(msgs), "sink", sinkName)
+
+	sink(sinkName).Send(n)
+}
+
+// Closes the notifications of messages that were read, archived or deleted
+// elsewhere. Notifications that still have other messages are updated instead.
+func (r *accountRunner) retract(msgIds []string) {
+	if r.digest != nil {
+		r.digest.remove(msgIds)
+	}
+
+	for _, thread := range r.coalescer.remove(msgIds) {
+		s := sink(thread.sink)
+
+		dismisser, ok := s.(services.NotificationDismisser)
+		if !ok || !dismisser.Dismiss(thread.key) {
+			continue
+		}
+
+		app.Logger().Debug("retracted gmail notification", "account", r.acc.Name, "threadId", thread.threadId)
+
+		if len(thread.msgs) == 0 {
+			continue
+		}
+
+		// Only resent if it was still shown, otherwise a notification the user
+		// already closed would pop up again
+		app.Logger().Debug("updating gmail notification after messages were removed", "account", r.acc.Name, "threadId", thread.threadId, "messages", len(thread.msgs))
+
+		s.Send(thread.notification(services.NotificationSound_None, r.notificationActions()))
+	}
+}
+
+// Opens the notification's latest message when clicked, and queues any other
+// action for every message it shows.
+func (r *accountRunner) handleAction(ev services.NotificationActionEvent) {
+	// Digests only open the inbox
+	if !strings.HasPrefix(ev.Key, r.coalescer.keyPrefix) {
+		if ev.ActionId == services.NotificationActionId_Default {
+			r.open(messageUrl(r.email, ""))
+		}
+
+		return
+	}
+
+	thread := r.coalescer.find(ev.Key)
+
+	if ev.ActionId == services.NotificationActionId_Default {
+		// Forgotten groups can still be opened by thread id
+		id, _, _ := strings.Cut(strings.TrimPrefix(ev.Key, r.coalescer.keyPrefix), "/")
+		if thread != nil {
+			id = thread.latest().msg.Id
+		}
+
+		r.open(messageUrl(r.email, id))
+		return
+	}
+
+	action := MessageAction(ev.ActionId)
+	if !action.IsValid() {
+		app.Logger().Warn("unknown gmail notification action", "account", r.acc.Name, "action", ev.ActionId)
+		return
+	}
+
+	if thread == nil {
+		app.Logger().Warn("action picked on a gmail notification that is no longer known", "account", r.acc.Name, "key", ev.Key, "action", action)
+		return
+	}
+
+	msgIds := make([]string, len(thread.msgs))
+	for i, m := range thread.msgs {
+		msgIds[i] = m.msg.Id
+	}
+
+	app.Logger().Debug("queueing gmail action", "account", r.acc.Name, "action", action, "threadId", thread.threadId, "messageIds", msgIds)
+	r.actions.enqueue(action, msgIds)
+}
+
+func (r *accountRunner) open(link string) {
+	app.Logger().Debug("opening gmail", "account", r.acc.Name, "url", link)
+
+	if err := r.opts.UrlOpener.Open(link); err != nil {
+		app.Logger().Error("failed to open gmail", "account", r.acc.Name, "url", link, "error", err)
+	}
+}
+
+func (r *accountRunner) notificationActions() []services.NotificationAction {
+	actions := []services.NotificationAction{{Id: services.NotificationActionId_Default, Label: "Open"}}
+	for _, a := range r.opts.NotificationActions {
+		actions = append(actions, services.NotificationAction{Id: string(a), Label: a.Label()})
+	}
+
+	return actions
+}
+
+// Link to a message or thread in the Gmail web client, signed in as email. An
+// empty id links to the inbox.
+func messageUrl(email string, id string) string {
+	link := fmt.Sprintf("https://mail.google.com/mail/u/%s/#inbox", url.PathEscape(email))
+	if id != "" {
+		link += "/" + id
+	}
+
+	return link
+}
+
+func sink(name string) services.NotificationSink {
+	sink, ok := app.NotificationSink(name)
+	if !ok {
+		app.Logger().Warn("notification sink does not exist, using the default", "sink", name)
+		return app.NotificationService()
+	}
+
+	return sink
+}
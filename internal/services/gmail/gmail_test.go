@@ -0,0 +1,138 @@
+package gmail
+
+import (
+	"net/mail"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/rules"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+// Records opened urls instead of opening a browser
+type fakeOpener struct {
+	urls []string
+}
+
+func (o *fakeOpener) Open(url string) error {
+	o.urls = append(o.urls, url)
+	return nil
+}
+
+func TestMessageUrl(t *testing.T) {
+	tests := []struct {
+		email string
+		id    string
+		want  string
+	}{
+		{"jdoe@example.com", "", "https://mail.google.com/mail/u/jdoe@example.com/#inbox"},
+		{"jdoe@example.com", "18c2f0a1b2c3d4e5", "https://mail.google.com/mail/u/jdoe@example.com/#inbox/18c2f0a1b2c3d4e5"},
+		{"j+alerts@example.com", "abc", "https://mail.google.com/mail/u/j+alerts@example.com/#inbox/abc"},
+		{"j/doe#x@example.com", "", "https://mail.google.com/mail/u/j%2Fdoe%23x@example.com/#inbox"},
+	}
+
+	for _, tt := range tests {
+		if got := messageUrl(tt.email, tt.id); got != tt.want {
+			t.Errorf("messageUrl(%q, %q) = %q, want %q", tt.email, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestHandleActionOpens(t *testing.T) {
+	const email = "jdoe@example.com"
+
+	newRunner := func(opener *fakeOpener) (*accountRunner, *threadGroup) {
+		r := &accountRunner{
+			opts:      Options{UrlOpener: opener},
+			acc:       Account{Name: "work"},
+			email:     email,
+			coalescer: newThreadCoalescer("gmail/work/thread/", time.Minute),
+		}
+
+		now := time.Now()
+		msgs := []*gworkspace.GmailMessage{
+			{Id: "m1", ThreadId: "t1", InternalDate: now.Add(-time.Minute)},
+			{Id: "m2", ThreadId: "t1", InternalDate: now},
+		}
+
+		groups := r.coalescer.add(now, msgs, []rules.Action{{}, {}})
+
+		return r, groups[0]
+	}
+
+	tests := []struct {
+		name string
+		// Builds the key of the clicked notification from the notified group
+		key      func(g *threadGroup) string
+		actionId string
+		want     []string
+	}{
+		{
+			name:     "thread",
+			key:      func(g *threadGroup) string { return g.key },
+			actionId: services.NotificationActionId_Default,
+			want:     []string{messageUrl(email, "m2")},
+		},
+		{
+			name:     "forgotten thread",
+			key:      func(*threadGroup) string { return "gmail/work/thread/t9/m9" },
+			actionId: services.NotificationActionId_Default,
+			want:     []string{messageUrl(email, "t9")},
+		},
+		{
+			name:     "digest",
+			key:      func(*threadGroup) string { return "gmail/work/digest/1700000000000" },
+			actionId: services.NotificationActionId_Default,
+			want:     []string{messageUrl(email, "")},
+		},
+		{
+			name:     "digest action",
+			key:      func(*threadGroup) string { return "gmail/work/digest/1700000000000" },
+			actionId: string(MessageAction_Archive),
+		},
+		{
+			name:     "forgotten thread action",
+			key:      func(*threadGroup) string { return "gmail/work/thread/t9/m9" },
+			actionId: string(MessageAction_Archive),
+		},
+		{
+			name:     "unknown action",
+			key:      func(g *threadGroup) string { return g.key },
+			actionId: "reply",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opener := &fakeOpener{}
+			r, g := newRunner(opener)
+
+			r.handleAction(services.NotificationActionEvent{Key: tt.key(g), ActionId: tt.actionId})
+
+			if !slices.Equal(opener.urls, tt.want) {
+				t.Errorf("opened %q, want %q", opener.urls, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestNotificationCarriesSendersAndLabels(t *testing.T) {
+	now := time.Now()
+	msgs := []threadMessage{
+		{msg: &gworkspace.GmailMessage{Id: "m1", From: &mail.Address{Name: "News", Address: "news@example.com"}, LabelIds: []string{"INBOX"}, InternalDate: now}},
+		{msg: &gworkspace.GmailMessage{Id: "m2", From: &mail.Address{Name: "Boss", Address: "boss@example.com"}, LabelIds: []string{"INBOX", "Label_7"}, InternalDate: now.Add(time.Second)}},
+		{msg: &gworkspace.GmailMessage{Id: "m3", From: &mail.Address{Name: "News", Address: "news@example.com"}, LabelIds: []string{"INBOX"}, InternalDate: now.Add(time.Second * 2)}},
+	}
+
+	n := digestNotification("gmail/work/digest/1", msgs, nil)
+
+	if want := []string{"news@example.com", "boss@example.com"}; !slices.Equal(n.Senders, want) {
+		t.Errorf("digest senders = %q, want %q", n.Senders, want)
+	}
+
+	if want := []string{"INBOX", "Label_7"}; !slices.Equal(n.Labels, want) {
+		t.Errorf("digest labels = %q, want %q", n.Labels, want)
+	}
+}
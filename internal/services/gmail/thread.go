@@ -0,0 +1,252 @@
+package gmail
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/rules"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+const (
+	// Number of notified thread groups remembered so that their notifications can
+	// be taken back once their messages are read
+	maxThreadGroups = 256
+)
+
+type threadMessage struct {
+	msg    *gworkspace.GmailMessage
+	action rules.Action
+}
+
+// Messages of a thread that are reported together in a single notification.
+type threadGroup struct {
+	// Notification key
+	key      string
+	threadId string
+	subject  string
+	// Oldest first
+	msgs       []threadMessage
+	lastUpdate time.Time
+
+	// Sink the notification was last sent to
+	sink string
+}
+
+// Groups new messages by thread so that a busy thread updates one notification
+// instead of sending one per message. Messages arriving within window of the
+// last message of a thread are added to the existing group. Not safe for
+// concurrent use.
+type threadCoalescer struct {
+	keyPrefix string
+	window    time.Duration
+
+	// Groups that new messages are added to, by thread id
+	active map[string]*threadGroup
+	// Every remembered group, oldest first
+	groups []*threadGroup
+}
+
+func newThreadCoalescer(keyPrefix string, window time.Duration) *threadCoalescer {
+	return &threadCoalescer{
+		keyPrefix: keyPrefix,
+		window:    window,
+		active:    make(map[string]*threadGroup),
+		groups:    make([]*threadGroup, 0),
+	}
+}
+
+// Adds messages and returns the groups that changed, in the order their latest
+// message arrived. actions must hold the action for each message.
+func (c *threadCoalescer) add(now time.Time, msgs []*gworkspace.GmailMessage, actions []rules.Action) []*threadGroup {
+	for threadId, g := range c.active {
+		if now.Sub(g.lastUpdate) > c.window {
+			delete(c.active, threadId)
+		}
+	}
+
+	changed := make([]*threadGroup, 0)
+
+	for i, msg := range msgs {
+		threadId := msg.ThreadId
+		if threadId == "" {
+			threadId = msg.Id
+		}
+
+		g, ok := c.active[threadId]
+		if !ok {
+			g = &threadGroup{
+				key:      fmt.Sprintf("%s%s/%s", c.keyPrefix, threadId, msg.Id),
+				threadId: threadId,
+				subject:  msg.Subject,
+			}
+
+			c.active[threadId] = g
+			c.groups = append(c.groups, g)
+		}
+
+		g.msgs = append(g.msgs, threadMessage{msg: msg, action: actions[i]})
+		g.lastUpdate = now
+
+		if !slices.Contains(changed, g) {
+			changed = append(changed, g)
+		}
+	}
+
+	for _, g := range changed {
+		slices.SortStableFunc(g.msgs, func(a, b threadMessage) int {
+			return a.msg.InternalDate.Compare(b.msg.InternalDate)
+		})
+	}
+
+	slices.SortStableFunc(changed, func(a, b *threadGroup) int {
+		return a.latest().msg.InternalDate.Compare(b.latest().msg.InternalDate)
+	})
+
+	if n := len(c.groups) - maxThreadGroups; n > 0 {
+		for _, g := range c.groups[:n] {
+			c.forget(g)
+		}
+	}
+
+	return changed
+}
+
+// Removes messages from their groups and returns the groups that changed.
+// Groups left without messages are forgotten.
+func (c *threadCoalescer) remove(msgIds []string) []*threadGroup {
+	changed := make([]*threadGroup, 0)
+
+	for _, g := range slices.Clone(c.groups) {
+		n := len(g.msgs)
+		g.msgs = slices.DeleteFunc(g.msgs, func(m threadMessage) bool {
+			return slices.Contains(msgIds, m.msg.Id)
+		})
+
+		if len(g.msgs) == n {
+			continue
+		}
+
+		changed = append(changed, g)
+
+		if len(g.msgs) == 0 {
+			c.forget(g)
+		}
+	}
+
+	return changed
+}
+
+// Returns the remembered group with the notification key, or nil.
+func (c *threadCoalescer) find(key string) *threadGroup {
+	i := slices.IndexFunc(c.groups, func(g *threadGroup) bool { return g.key == key })
+	if i == -1 {
+		return nil
+	}
+
+	return c.groups[i]
+}
+
+func (c *threadCoalescer) forget(g *threadGroup) {
+	c.groups = slices.DeleteFunc(c.groups, func(other *threadGroup) bool { return other == g })
+	if c.active[g.threadId] == g {
+		delete(c.active, g.threadId)
+	}
+}
+
+func (g *threadGroup) latest() threadMessage {
+	return g.msgs[len(g.msgs)-1]
+}
+
+func (g *threadGroup) urgent() bool {
+	return slices.ContainsFunc(g.msgs, func(m threadMessage) bool { return m.action.Urgent })
+}
+
+// Distinct sender addresses of msgs, in the order they first appear
+func senderAddresses(msgs []threadMessage) []string {
+	addrs := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		if m.msg.From != nil && !slices.Contains(addrs, m.msg.From.Address) {
+			addrs = append(addrs, m.msg.From.Address)
+		}
+	}
+
+	return addrs
+}
+
+// Distinct label ids of msgs, in the order they first appear
+func labelIds(msgs []threadMessage) []string {
+	ids := make([]string, 0)
+	for _, m := range msgs {
+		for _, id := range m.msg.LabelIds {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// Number of distinct senders
+func (g *threadGroup) participants() int {
+	senders := make(map[string]struct{})
+	for _, m := range g.msgs {
+		if m.msg.From != nil {
+			senders[strings.ToLower(m.msg.From.Address)] = struct{}{}
+		}
+	}
+
+	return len(senders)
+}
+
+func (g *threadGroup) notification(sound services.NotificationSound, actions []services.NotificationAction) *services.Notification {
+	latest := g.latest()
+
+	return &services.Notification{
+		Key:     g.key,
+		Title:   g.title(),
+		Body:    g.body(),
+		Icon:    latest.action.Icon,
+		Urgent:  g.urgent(),
+		Sound:   sound,
+		Actions: actions,
+		Senders: senderAddresses(g.msgs),
+		Labels:  labelIds(g.msgs),
+	}
+}
+
+func (g *threadGroup) title() string {
+	if len(g.msgs) == 1 {
+		return g.latest().msg.Sender()
+	}
+
+	return g.subject
+}
+
+func (g *threadGroup) body() string {
+	latest := g.latest().msg
+
+	if len(g.msgs) == 1 {
+		if latest.Snippet == "" {
+			return latest.Subject
+		}
+
+		return latest.Subject + "\n" + latest.Snippet
+	}
+
+	participants := "1 participant"
+	if n := g.participants(); n != 1 {
+		participants = fmt.Sprintf("%d participants", n)
+	}
+
+	body := fmt.Sprintf("%d messages, %s", len(g.msgs), participants)
+	if latest.Snippet != "" {
+		body += fmt.Sprintf("\n%s: %s", latest.Sender(), latest.Snippet)
+	}
+
+	return body
+}
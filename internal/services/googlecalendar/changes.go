@@ -0,0 +1,111 @@
+package googlecalendar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/gworkspace"
+)
+
+// Summarizes what changed about an event the user cares about, such as
+// "Standup moved 10:00 → 10:30" or "Standup location changed". Returns false
+// if nothing they care about changed, such as only the description.
+func describeChange(now time.Time, c gworkspace.CalendarChange) (title string, body string, ok bool) {
+	prev, ev := c.Previous, c.Event
+
+	if c.Type == gworkspace.CalendarChangeType_Deleted || ev.Status == "cancelled" {
+		return eventTitle(prev) + " cancelled", "Was scheduled " + uncapitalize(reminderBody(now, prev)), true
+	}
+
+	parts := make([]string, 0)
+	details := make([]string, 0)
+
+	if !prev.Start.Equal(ev.Start) || !prev.End.Equal(ev.End) {
+		parts = append(parts, "moved "+describeMove(prev, ev))
+	}
+
+	if prev.Location != ev.Location {
+		parts = append(parts, "location changed")
+		details = append(details, fmt.Sprintf("%s → %s", orNone(prev.Location), orNone(ev.Location)))
+	}
+
+	if prev.VideoLink != ev.VideoLink {
+		parts = append(parts, "video link changed")
+		if ev.VideoLink == "" {
+			details = append(details, "Video link removed")
+		} else {
+			details = append(details, "Join at "+ev.VideoLink)
+		}
+	}
+
+	if len(parts) == 0 {
+		return "", "", false
+	}
+
+	details = append(details, reminderBody(now, ev))
+
+	return eventTitle(ev) + " " + strings.Join(parts, ", "), strings.Join(details, "\n"), true
+}
+
+// Such as "10:00 → 10:30", "Mon 10:00 → Tue 10:00" or "10:00–11:00 →
+// 10:00–11:30" when only the end moved. Times are shown in the local timezone.
+func describeMove(prev *gworkspace.CalendarEvent, ev *gworkspace.CalendarEvent) string {
+	if prev.AllDay || ev.AllDay {
+		return fmt.Sprintf("%s → %s", describeDays(prev), describeDays(ev))
+	}
+
+	prevStart, start := prev.Start.In(time.Local), ev.Start.In(time.Local)
+
+	layout := "15:04"
+	if !sameDay(prevStart, start) {
+		layout = "Mon 15:04"
+	}
+
+	if prevStart.Equal(start) {
+		return fmt.Sprintf("%s–%s → %s–%s",
+			prevStart.Format(layout), prev.End.In(time.Local).Format("15:04"),
+			start.Format(layout), ev.End.In(time.Local).Format("15:04"))
+	}
+
+	return fmt.Sprintf("%s → %s", prevStart.Format(layout), start.Format(layout))
+}
+
+// Such as "Jan 2" or "Jan 2–4" for an all-day event, or the start date of a
+// timed event.
+func describeDays(ev *gworkspace.CalendarEvent) string {
+	if !ev.AllDay {
+		return ev.Start.In(time.Local).Format("Jan 2 15:04")
+	}
+
+	// End is exclusive
+	last := ev.End.AddDate(0, 0, -1)
+	if !last.After(ev.Start) {
+		return ev.Start.Format("Jan 2")
+	}
+
+	return ev.Start.Format("Jan 2") + "–" + last.Format("Jan 2")
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+
+	return ay == by && am == bm && ad == bd
+}
+
+func uncapitalize(s string) string {
+	if s == "" {
+		return s
+	}
+
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+
+	return s
+}
@@ -2,26 +2,608 @@ package googlecalendar
 
 import (
 	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/browser"
+	"github.com/link00000000/gwsn/internal/gworkspace"
 	"github.com/link00000000/gwsn/internal/services"
+	"github.com/link00000000/gwsn/internal/state"
+	"golang.org/x/sync/errgroup"
+	calendarapi "google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
 )
 
-type googleCalendarService struct{}
+const (
+	// How often reminders are checked against the cached events. Kept short so
+	// that reminders fire on time between polls.
+	reminderCheckInterval = time.Second * 30
+
+	minAccountRetryInterval = time.Second * 30
+	maxAccountRetryInterval = time.Minute * 15
+
+	// Opens the video meeting of an event
+	actionId_Join = "join"
+)
+
+type Account struct {
+	Name string
+	// May be shared with other services using the same account
+	Client *gworkspace.HttpClient
+}
+
+type Options struct {
+	PollingInterval time.Duration
+	// How far ahead events are looked at for reminders. Reminders further ahead
+	// than this fire late.
+	Lookahead time.Duration
+	// Changes to events starting further ahead than this are not notified. Zero
+	// notifies changes to any upcoming event.
+	ChangeHorizon time.Duration
+
+	// Remembers the synced events and which reminders fired between runs. May be
+	// nil.
+	State state.Store
+
+	// Opens events when a notification is clicked. Defaults to the system
+	// browser.
+	UrlOpener browser.Opener
+}
+
+type googleCalendarService struct {
+	opts     Options
+	accounts []Account
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	// By account name, once the account is running
+	runners map[string]*accountRunner
+
+	agendaUpdates chan struct{}
+}
 
 var _ services.GoogleCalendarService = (*googleCalendarService)(nil)
 
-func NewService() *googleCalendarService {
-	return &googleCalendarService{}
+func NewService(opts Options, accounts []Account) *googleCalendarService {
+	if opts.UrlOpener == nil {
+		opts.UrlOpener = browser.System
+	}
+
+	return &googleCalendarService{
+		opts:     opts,
+		accounts: accounts,
+		runners:  make(map[string]*accountRunner),
+
+		agendaUpdates: make(chan struct{}, 1),
+	}
 }
 
 func (*googleCalendarService) Setup() error {
 	return nil
 }
 
-func (*googleCalendarService) Run(ctx context.Context) error {
+func (svc *googleCalendarService) Scopes(account string) []string {
+	if !slices.ContainsFunc(svc.accounts, func(acc Account) bool { return acc.Name == account }) {
+		return nil
+	}
+
+	// Responding to invitations modifies events, the list of calendars is only
+	// readable with the broader scope
+	return []string{calendarapi.CalendarReadonlyScope, calendarapi.CalendarEventsScope}
+}
+
+// Whether the email is an invitation to an event the service notifies about,
+// so the email does not need a notification of its own. Answered from the
+// synced events without waiting on the Calendar API. If the event is not known
+// yet, as the email may arrive before the next poll, a sync is requested so
+// that the invitation follows soon, and the email is notified as well.
+func (svc *googleCalendarService) IsPendingInvitation(ctx context.Context, account string, email services.InvitationEmail) bool {
+	// Without the UID, only emails that Google Calendar sent on behalf of the
+	// organizer can be told apart from other emails with a similar subject
+	summary, hasSummary := invitationSummary(email.Subject)
+	if email.ICalUID == "" && (!hasSummary || email.FromAddress == "") {
+		return false
+	}
+
+	svc.mu.Lock()
+	r, ok := svc.runners[account]
+	svc.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	match := func(ev *gworkspace.CalendarEvent) bool {
+		if email.ICalUID != "" {
+			return ev.ICalUID == email.ICalUID
+		}
+
+		return ev.Summary == summary && strings.EqualFold(ev.OrganizerEmail, email.FromAddress)
+	}
+
+	if slices.ContainsFunc(r.monitor.Invitations(), match) {
+		return true
+	}
+
+	r.monitor.RequestRefresh()
+
+	return false
+}
+
+// Watches the calendars of every configured account and raises reminders
+// before events start. Blocks until ctx is cancelled or Shutdown is called.
+func (svc *googleCalendarService) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	svc.mu.Lock()
+	svc.cancel = cancel
+	svc.done = make(chan struct{})
+	done := svc.done
+	svc.mu.Unlock()
+
+	defer close(done)
+
+	// Accounts run independently, one that can't be reached or is no longer
+	// authorized does not stop the others
+	var wg sync.WaitGroup
+
+	for _, acc := range svc.accounts {
+		acc.Client.CircuitBreaker().OnStateChange(func(state gworkspace.CircuitState) {
+			app.SystemTrayService().SetServiceDegraded("Calendar ("+acc.Name+")", state != gworkspace.CircuitState_Closed)
+		})
+
+		// Subscribed once, so that restarts of the account don't pile up
+		// subscriptions
+		actionEvents := app.NotificationService().SubscribeActions(fmt.Sprintf("calendar/%s/", acc.Name))
+
+		wg.Go(func() { svc.superviseAccount(ctx, acc, actionEvents) })
+	}
+
+	wg.Wait()
+
 	return nil
 }
 
-func (*googleCalendarService) Shutdown() error {
+// Stops watching and waits for every account to exit.
+func (svc *googleCalendarService) Shutdown() error {
+	svc.mu.Lock()
+	cancel, done := svc.cancel, svc.done
+	svc.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	<-done
+
 	return nil
 }
+
+func (svc *googleCalendarService) Agenda(from time.Time, until time.Time) []services.CalendarEntry {
+	svc.mu.Lock()
+	runners := slices.Collect(maps.Values(svc.runners))
+	svc.mu.Unlock()
+
+	entries := make([]services.CalendarEntry, 0)
+	for _, r := range runners {
+		for _, ev := range r.monitor.EventsBetween(from, until) {
+			if ev.Status == "cancelled" || ev.ResponseStatus == "declined" {
+				continue
+			}
+
+			entries = append(entries, services.CalendarEntry{
+				Title:    eventTitle(ev),
+				Start:    ev.Start,
+				End:      ev.End,
+				AllDay:   ev.AllDay,
+				Link:     ev.HtmlLink,
+				JoinLink: ev.VideoLink,
+			})
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b services.CalendarEntry) int { return a.Start.Compare(b.Start) })
+
+	return entries
+}
+
+func (svc *googleCalendarService) AgendaUpdates() <-chan struct{} {
+	return svc.agendaUpdates
+}
+
+func (svc *googleCalendarService) updateAgenda() {
+	select {
+	case svc.agendaUpdates <- struct{}{}:
+	default:
+		// An update is already pending
+	}
+}
+
+// Runs the account until ctx is cancelled, restarting it with backoff whenever
+// it fails, such as when starting offline or after the token was revoked.
+func (svc *googleCalendarService) superviseAccount(ctx context.Context, acc Account, actionEvents <-chan services.NotificationActionEvent) {
+	retryInterval := minAccountRetryInterval
+
+	for {
+		started := time.Now()
+		err := svc.runAccount(ctx, acc, actionEvents)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Failures after a long healthy run start over with a short interval
+		if time.Since(started) > maxAccountRetryInterval {
+			retryInterval = minAccountRetryInterval
+		}
+
+		app.Logger().Error("calendar account stopped, restarting later", "account", acc.Name, "interval", retryInterval, "error", err)
+
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		retryInterval = min(retryInterval*2, maxAccountRetryInterval)
+	}
+}
+
+func (svc *googleCalendarService) runAccount(ctx context.Context, acc Account, actionEvents <-chan services.NotificationActionEvent) error {
+	if err := acc.Client.Configure(ctx, app.GoogleScopes(acc.Name)...); err != nil {
+		return fmt.Errorf("failed to configure http client for account %s: %v", acc.Name, err)
+	}
+
+	csvc, err := calendarapi.NewService(ctx, option.WithHTTPClient(acc.Client.Client))
+	if err != nil {
+		return fmt.Errorf("failed to create calendar api service for account %s: %v", acc.Name, err)
+	}
+
+	monitor := gworkspace.NewCalendarMonitor(csvc, gworkspace.CalendarMonitorOptions{
+		UpdateFreq: svc.opts.PollingInterval,
+		Lookahead:  svc.opts.Lookahead,
+		State:      svc.opts.State,
+		StateKey:   "calendar/" + acc.Name + "/sync",
+	})
+
+	monitor.Initialize()
+
+	// Calendars that failed to sync are retried by Watch
+	if err := monitor.Refresh(ctx); err != nil {
+		app.Logger().Error("failed to sync calendar events", "account", acc.Name, "error", err)
+	}
+
+	r := &accountRunner{
+		opts:            svc.opts,
+		acc:             acc,
+		monitor:         monitor,
+		reminders:       newReminderTracker(svc.opts.State, "calendar/"+acc.Name+"/reminders"),
+		invitations:     newInvitationTracker(svc.opts.State, "calendar/"+acc.Name+"/invitations"),
+		eventKeyPrefix:  fmt.Sprintf("calendar/%s/event/", acc.Name),
+		inviteKeyPrefix: fmt.Sprintf("calendar/%s/invite/", acc.Name),
+	}
+
+	svc.mu.Lock()
+	svc.runners[acc.Name] = r
+	svc.mu.Unlock()
+
+	svc.updateAgenda()
+
+	defer func() {
+		svc.mu.Lock()
+		delete(svc.runners, acc.Name)
+		svc.mu.Unlock()
+
+		svc.updateAgenda()
+	}()
+
+	changes := monitor.Subscribe()
+	defer monitor.Unsubscribe(changes)
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error { return monitor.Watch(ctx) })
+	g.Go(func() error {
+		ticker := time.NewTicker(reminderCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			r.remind(time.Now())
+			r.invite(time.Now())
+
+			select {
+			case <-ticker.C:
+			case ev := <-actionEvents:
+				r.handleAction(ctx, ev)
+			case c := <-changes.Changes():
+				r.notifyChanges(time.Now(), c)
+				svc.updateAgenda()
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+// Turns the events of a single account into notifications.
+type accountRunner struct {
+	opts        Options
+	acc         Account
+	monitor     *gworkspace.CalendarMonitor
+	reminders   *reminderTracker
+	invitations *invitationTracker
+
+	eventKeyPrefix  string
+	inviteKeyPrefix string
+}
+
+func (r *accountRunner) remind(now time.Time) {
+	for _, ev := range r.reminders.due(now, r.monitor.Events()) {
+		app.Logger().Debug("sending calendar reminder", "account", r.acc.Name, "eventId", ev.Id, "summary", ev.Summary, "start", ev.Start)
+
+		app.NotificationService().Send(&services.Notification{
+			Key:     r.notificationKey(ev),
+			Title:   eventTitle(ev),
+			Body:    reminderBody(now, ev),
+			Actions: eventActions(ev),
+			Expires: reminderDeadline(ev),
+		})
+	}
+}
+
+func (r *accountRunner) notifyChanges(now time.Time, changes []gworkspace.CalendarChange) {
+	for _, c := range changes {
+		if !r.shouldNotifyChange(now, c) {
+			continue
+		}
+
+		title, body, ok := describeChange(now, c)
+		if !ok {
+			continue
+		}
+
+		app.Logger().Debug("sending calendar change", "account", r.acc.Name, "eventId", c.Event.Id, "type", c.Type, "title", title)
+
+		app.NotificationService().Send(&services.Notification{
+			Key:     r.notificationKey(c.Event),
+			Title:   title,
+			Body:    body,
+			Actions: eventActions(c.Event),
+		})
+	}
+}
+
+// Only changes by someone else to upcoming events the user attends, within the
+// change horizon, are worth a notification.
+func (r *accountRunner) shouldNotifyChange(now time.Time, c gworkspace.CalendarChange) bool {
+	// New events are invitations, not changes
+	if c.Previous == nil {
+		return false
+	}
+
+	// The api does not say who changed an event. Events the user organizes can
+	// only be moved or cancelled by them.
+	if c.Previous.OrganizedBySelf || c.Event.OrganizedBySelf {
+		return false
+	}
+
+	if c.Previous.ResponseStatus == "declined" {
+		return false
+	}
+
+	// Either side of a move may be upcoming
+	if c.Previous.End.Before(now) && c.Event.End.Before(now) {
+		return false
+	}
+
+	if r.opts.ChangeHorizon > 0 {
+		horizon := now.Add(r.opts.ChangeHorizon)
+		if c.Previous.Start.After(horizon) && c.Event.Start.After(horizon) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reminders and changes of the same event replace each other
+func (r *accountRunner) notificationKey(ev *gworkspace.CalendarEvent) string {
+	return r.eventKeyPrefix + ev.CalendarId + "/" + ev.Id
+}
+
+// Notifies new invitations and retracts the notifications of invitations that
+// have been answered elsewhere.
+func (r *accountRunner) invite(now time.Time) {
+	added, removed := r.invitations.update(r.monitor.Invitations())
+
+	for _, id := range removed {
+		app.NotificationService().Dismiss(r.inviteKeyPrefix + id)
+	}
+
+	for _, ev := range added {
+		app.Logger().Debug("sending calendar invitation", "account", r.acc.Name, "eventId", ev.Id, "summary", ev.Summary, "start", ev.Start)
+		r.sendInvitation(now, ev)
+	}
+}
+
+func (r *accountRunner) sendInvitation(now time.Time, ev *gworkspace.CalendarEvent) {
+	body := reminderBody(now, ev)
+	if ev.Organizer != "" {
+		body = "From " + ev.Organizer + "\n" + body
+	}
+
+	app.NotificationService().Send(&services.Notification{
+		Key:   r.inviteKeyPrefix + invitationId(ev),
+		Title: "Invitation: " + eventTitle(ev),
+		Body:  body,
+		Actions: []services.NotificationAction{
+			{Id: services.NotificationActionId_Default, Label: "Open"},
+			{Id: responseStatus_Accepted, Label: "Accept"},
+			{Id: responseStatus_Declined, Label: "Decline"},
+			{Id: responseStatus_Tentative, Label: "Maybe"},
+		},
+		// Answering is still possible later, but pointless
+		Expires: ev.End,
+	})
+}
+
+// Returns the first instance of the pending invitation with the id, or nil.
+func (r *accountRunner) invitation(id string) *gworkspace.CalendarEvent {
+	for _, ev := range r.monitor.Invitations() {
+		if invitationId(ev) == id {
+			return ev
+		}
+	}
+
+	return nil
+}
+
+func (r *accountRunner) handleAction(ctx context.Context, ev services.NotificationActionEvent) {
+	if id, ok := strings.CutPrefix(ev.Key, r.inviteKeyPrefix); ok {
+		r.handleInvitationAction(ctx, id, ev.ActionId)
+		return
+	}
+
+	calendarId, eventId, ok := strings.Cut(strings.TrimPrefix(ev.Key, r.eventKeyPrefix), "/")
+	if !ok {
+		return
+	}
+
+	event := r.monitor.Event(calendarId, eventId)
+	if event == nil {
+		app.Logger().Warn("clicked calendar notification of an event that is no longer known", "account", r.acc.Name, "key", ev.Key)
+		return
+	}
+
+	var link string
+	switch ev.ActionId {
+	case services.NotificationActionId_Default:
+		link = event.HtmlLink
+	case actionId_Join:
+		link = event.VideoLink
+	}
+
+	if link == "" {
+		return
+	}
+
+	if err := r.opts.UrlOpener.Open(link); err != nil {
+		app.Logger().Error("failed to open calendar event", "account", r.acc.Name, "url", link, "error", err)
+	}
+}
+
+func (r *accountRunner) handleInvitationAction(ctx context.Context, id string, actionId string) {
+	event := r.invitation(id)
+	if event == nil {
+		app.Logger().Warn("clicked calendar invitation that is no longer pending", "account", r.acc.Name, "invitationId", id)
+		return
+	}
+
+	if actionId == services.NotificationActionId_Default {
+		if err := r.opts.UrlOpener.Open(event.HtmlLink); err != nil {
+			app.Logger().Error("failed to open calendar event", "account", r.acc.Name, "url", event.HtmlLink, "error", err)
+		}
+
+		return
+	}
+
+	calendarId, eventId, _ := strings.Cut(id, "/")
+
+	app.Logger().Info("responding to calendar invitation", "account", r.acc.Name, "eventId", eventId, "response", actionId)
+
+	if err := r.monitor.Respond(ctx, calendarId, eventId, actionId); err != nil {
+		app.Logger().Error("failed to respond to calendar invitation", "account", r.acc.Name, "eventId", eventId, "response", actionId, "error", err)
+
+		// Shown again so that the user can retry
+		r.sendInvitation(time.Now(), event)
+		return
+	}
+
+	// Picks up the response, so the invitation is no longer pending
+	if err := r.monitor.Refresh(ctx); err != nil {
+		app.Logger().Error("failed to sync calendar events", "account", r.acc.Name, "error", err)
+	}
+}
+
+// Open, plus Join if the event has a video meeting.
+func eventActions(ev *gworkspace.CalendarEvent) []services.NotificationAction {
+	actions := []services.NotificationAction{{Id: services.NotificationActionId_Default, Label: "Open"}}
+	if ev.VideoLink != "" && ev.Status != "cancelled" {
+		actions = append(actions, services.NotificationAction{Id: actionId_Join, Label: "Join"})
+	}
+
+	return actions
+}
+
+func eventTitle(ev *gworkspace.CalendarEvent) string {
+	if ev.Summary == "" {
+		return "(No title)"
+	}
+
+	return ev.Summary
+}
+
+// Such as "In 10 minutes at 14:30" or "All day tomorrow", followed by the
+// location. Times are shown in the local timezone.
+func reminderBody(now time.Time, ev *gworkspace.CalendarEvent) string {
+	var when string
+
+	if ev.AllDay {
+		when = "All day " + relativeDay(now, ev.Start)
+	} else {
+		start := ev.Start.In(time.Local)
+		until := start.Sub(now).Round(time.Minute)
+
+		switch {
+		case until <= 0:
+			when = fmt.Sprintf("Now at %s", start.Format("15:04"))
+		case until < time.Hour:
+			when = fmt.Sprintf("In %d minutes at %s", int(until.Minutes()), start.Format("15:04"))
+		default:
+			when = fmt.Sprintf("%s at %s", capitalize(relativeDay(now, start)), start.Format("15:04"))
+		}
+	}
+
+	if ev.Location != "" {
+		when += "\n" + ev.Location
+	}
+
+	return when
+}
+
+// Such as "today", "tomorrow" or "on Mon, Jan 2", for the calendar day of t.
+func relativeDay(now time.Time, t time.Time) string {
+	// All-day events are compared by their date, whatever timezone they start in
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+
+	ny, nm, nd := now.In(time.Local).Date()
+	today := time.Date(ny, nm, nd, 0, 0, 0, 0, time.Local)
+
+	switch day.Sub(today).Round(time.Hour) / (time.Hour * 24) {
+	case 0:
+		return "today"
+	case 1:
+		return "tomorrow"
+	default:
+		return "on " + day.Format("Mon, Jan 2")
+	}
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,127 @@
+package googlecalendar
+
+import (
+	"strings"
+
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/state"
+)
+
+// Response statuses, also used as the ids of the notification actions that set
+// them
+const (
+	responseStatus_Accepted  = "accepted"
+	responseStatus_Declined  = "declined"
+	responseStatus_Tentative = "tentative"
+)
+
+// Subject prefixes of the emails Google Calendar sends invitations with in
+// English. Only used for emails without a calendar part.
+var invitationSubjectPrefixes = []string{"Invitation: ", "Updated invitation: ", "Updated invitation with note: "}
+
+// Remembers which invitations were notified, so that each is notified once even
+// across polls and restarts.
+type invitationTracker struct {
+	state    state.Store
+	stateKey string
+
+	// By invitation id
+	notified map[string]bool
+}
+
+// store may be nil.
+func newInvitationTracker(store state.Store, stateKey string) *invitationTracker {
+	t := &invitationTracker{
+		state:    store,
+		stateKey: stateKey,
+		notified: make(map[string]bool),
+	}
+
+	if store != nil {
+		if _, err := store.Load(stateKey, &t.notified); err != nil {
+			app.Logger().Warn("failed to restore notified calendar invitations", "key", stateKey, "error", err)
+		}
+	}
+
+	return t
+}
+
+// Compares the pending invitations against the ones notified before. Returns
+// the invitations that are new, one event per invitation, and the ids of the
+// notified invitations that have since been answered, cancelled or have ended.
+func (t *invitationTracker) update(invitations []*gworkspace.CalendarEvent) ([]*gworkspace.CalendarEvent, []string) {
+	pending := make(map[string]bool, len(invitations))
+	added := make([]*gworkspace.CalendarEvent, 0)
+	changed := false
+
+	// Ordered by start, so the first instance of a recurring event stands in for
+	// all of them
+	for _, ev := range invitations {
+		id := invitationId(ev)
+		if pending[id] {
+			continue
+		}
+
+		pending[id] = true
+
+		if !t.notified[id] {
+			t.notified[id] = true
+			added = append(added, ev)
+			changed = true
+		}
+	}
+
+	removed := make([]string, 0)
+	for id := range t.notified {
+		if !pending[id] {
+			delete(t.notified, id)
+			removed = append(removed, id)
+			changed = true
+		}
+	}
+
+	if changed {
+		t.saveState()
+	}
+
+	return added, removed
+}
+
+func (t *invitationTracker) saveState() {
+	if t.state == nil {
+		return
+	}
+
+	if err := t.state.Save(t.stateKey, t.notified); err != nil {
+		app.Logger().Error("failed to save notified calendar invitations", "key", t.stateKey, "error", err)
+	}
+}
+
+// Invitations to a recurring event are answered once for the whole series.
+// Returns the calendar id and the id of the event to respond to, separated by
+// a slash.
+func invitationId(ev *gworkspace.CalendarEvent) string {
+	if ev.RecurringEventId != "" {
+		return ev.CalendarId + "/" + ev.RecurringEventId
+	}
+
+	return ev.CalendarId + "/" + ev.Id
+}
+
+// The event summary in the subject of an invitation email, such as "Standup"
+// in "Invitation: Standup @ Mon Jan 2, 2026 10am - 10:30am (GMT) (me@example.com)".
+func invitationSummary(subject string) (string, bool) {
+	for _, prefix := range invitationSubjectPrefixes {
+		if rest, ok := strings.CutPrefix(subject, prefix); ok {
+			i := strings.LastIndex(rest, " @ ")
+			if i == -1 {
+				return "", false
+			}
+
+			return rest[:i], true
+		}
+	}
+
+	return "", false
+}
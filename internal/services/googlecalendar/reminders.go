@@ -0,0 +1,119 @@
+package googlecalendar
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/state"
+)
+
+// Remembers which reminders have fired, so that each fires once even across
+// polls and restarts.
+type reminderTracker struct {
+	state    state.Store
+	stateKey string
+
+	// Unix milliseconds of the end of the event, after which the entry is no
+	// longer needed, by reminder key
+	fired map[string]int64
+}
+
+// store may be nil.
+func newReminderTracker(store state.Store, stateKey string) *reminderTracker {
+	t := &reminderTracker{
+		state:    store,
+		stateKey: stateKey,
+		fired:    make(map[string]int64),
+	}
+
+	if store != nil {
+		if _, err := store.Load(stateKey, &t.fired); err != nil {
+			app.Logger().Warn("failed to restore fired calendar reminders", "key", stateKey, "error", err)
+		}
+	}
+
+	return t
+}
+
+// Returns the events with a reminder that is due at now and has not fired yet,
+// and marks their reminders as fired. Reminders that were missed, such as while
+// the app was not running, are still due until the event starts, or ends for
+// all-day events. Each event is returned at most once even if several of its
+// reminders are due.
+func (t *reminderTracker) due(now time.Time, events []*gworkspace.CalendarEvent) []*gworkspace.CalendarEvent {
+	dueEvents := make([]*gworkspace.CalendarEvent, 0)
+	changed := false
+
+	for key, end := range t.fired {
+		if now.After(time.UnixMilli(end)) {
+			delete(t.fired, key)
+			changed = true
+		}
+	}
+
+	for _, ev := range events {
+		if ev.Status == "cancelled" || ev.ResponseStatus == "declined" {
+			continue
+		}
+
+		if !now.Before(reminderDeadline(ev)) {
+			continue
+		}
+
+		isDue := false
+		for _, before := range ev.Reminders {
+			if now.Before(ev.Start.Add(-before)) {
+				continue
+			}
+
+			key := reminderKey(ev, before)
+			if _, ok := t.fired[key]; ok {
+				continue
+			}
+
+			t.fired[key] = ev.End.UnixMilli()
+			changed = true
+			isDue = true
+		}
+
+		if isDue {
+			dueEvents = append(dueEvents, ev)
+		}
+	}
+
+	if changed {
+		t.saveState()
+	}
+
+	slices.SortFunc(dueEvents, func(a, b *gworkspace.CalendarEvent) int { return a.Start.Compare(b.Start) })
+
+	return dueEvents
+}
+
+func (t *reminderTracker) saveState() {
+	if t.state == nil {
+		return
+	}
+
+	if err := t.state.Save(t.stateKey, t.fired); err != nil {
+		app.Logger().Error("failed to save fired calendar reminders", "key", t.stateKey, "error", err)
+	}
+}
+
+// Reminders are pointless once timed events start, or all-day events end.
+func reminderDeadline(ev *gworkspace.CalendarEvent) time.Time {
+	if ev.AllDay {
+		return ev.End
+	}
+
+	return ev.Start
+}
+
+// The start time is part of the key, so that reminders fire again for an event
+// that was moved
+func reminderKey(ev *gworkspace.CalendarEvent, before time.Duration) string {
+	return fmt.Sprintf("%s/%s/%d/%d", ev.CalendarId, ev.Id, ev.Start.Unix(), int64(before.Minutes()))
+}
@@ -0,0 +1,53 @@
+package notification
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+const (
+	actionSubscriptionBufferSize = 16
+)
+
+type actionSubscription struct {
+	keyPrefix string
+	ch        chan services.NotificationActionEvent
+}
+
+// Routes picked notification actions to the services that sent the
+// notifications.
+type actionDispatcher struct {
+	mu   sync.Mutex
+	subs []actionSubscription
+}
+
+func (d *actionDispatcher) subscribe(keyPrefix string) <-chan services.NotificationActionEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan services.NotificationActionEvent, actionSubscriptionBufferSize)
+	d.subs = append(d.subs, actionSubscription{keyPrefix: keyPrefix, ch: ch})
+
+	return ch
+}
+
+// Never blocks, events for subscribers that fall behind are dropped.
+func (d *actionDispatcher) dispatch(ev services.NotificationActionEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, sub := range d.subs {
+		if !strings.HasPrefix(ev.Key, sub.keyPrefix) {
+			continue
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+			app.Logger().Warn("dropped notification action, subscriber is not keeping up", "key", ev.Key, "action", ev.ActionId)
+		}
+	}
+}
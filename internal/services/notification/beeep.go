@@ -4,11 +4,13 @@ import (
 	"context"
 
 	"github.com/gen2brain/beeep"
+	"github.com/link00000000/gwsn/internal/app"
 	"github.com/link00000000/gwsn/internal/services"
 )
 
 type beeepNotificationService struct {
 	appName string
+	actions actionDispatcher
 }
 
 var _ services.NotificationService = (*beeepNotificationService)(nil)
@@ -33,6 +35,44 @@ func (*beeepNotificationService) Shutdown() error {
 	return nil
 }
 
+// beeep can only raise the urgency of a notification together with a beep, so
+// silent urgent notifications are sent with normal urgency.
+func (*beeepNotificationService) Send(n *services.Notification) {
+	var icon any = ""
+	if len(n.Icon) > 0 {
+		icon = n.Icon
+	}
+
+	var err error
+	switch {
+	case n.Sound == services.NotificationSound_Alert, n.Urgent && n.Sound != services.NotificationSound_None:
+		err = beeep.Alert(n.Title, n.Body, icon)
+
+	case n.Sound == services.NotificationSound_Beep:
+		err = beeep.Notify(n.Title, n.Body, icon)
+		if err == nil {
+			err = beeep.Beep(beeep.DefaultFreq, beeep.DefaultDuration)
+		}
+
+	default:
+		err = beeep.Notify(n.Title, n.Body, icon)
+	}
+
+	if err != nil {
+		app.Logger().Error("failed to send desktop notification", "title", n.Title, "error", err)
+	}
+}
+
+// beeep can't show actions, so the channel never receives anything.
+func (svc *beeepNotificationService) SubscribeActions(keyPrefix string) <-chan services.NotificationActionEvent {
+	return svc.actions.subscribe(keyPrefix)
+}
+
+// beeep has no handle on the notifications it sends.
+func (*beeepNotificationService) Dismiss(key string) bool {
+	return false
+}
+
 func (*beeepNotificationService) Notify(title, body string) {
 	beeep.Notify(title, body, "")
 }
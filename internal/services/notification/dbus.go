@@ -0,0 +1,235 @@
+//go:build linux || freebsd || netbsd || openbsd || illumos
+
+package notification
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	_ "image/png"
+	"sync"
+
+	"github.com/esiqveland/notify"
+	"github.com/godbus/dbus/v5"
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+// Talks to the freedesktop notification server over D-Bus directly, which
+// unlike beeep allows notifications to be replaced. Falls back to beeep when no
+// session bus is available.
+// See https://specifications.freedesktop.org/notification-spec/latest/
+type dbusNotificationService struct {
+	appName  string
+	fallback *beeepNotificationService
+
+	mu       sync.Mutex
+	conn     *dbus.Conn
+	notifier notify.Notifier
+	actions  actionDispatcher
+	// Server ids of the notifications that are still shown, by key
+	ids  map[string]uint32
+	keys map[uint32]string
+}
+
+var _ services.NotificationService = (*dbusNotificationService)(nil)
+
+func NewDbusNotificationService(appName string) *dbusNotificationService {
+	return &dbusNotificationService{
+		appName:  appName,
+		fallback: NewBeeepNotificationService(appName),
+		ids:      make(map[string]uint32),
+		keys:     make(map[uint32]string),
+	}
+}
+
+func (svc *dbusNotificationService) Setup() error {
+	if err := svc.fallback.Setup(); err != nil {
+		return err
+	}
+
+	conn, err := dbus.SessionBusPrivate()
+	if err == nil {
+		err = conn.Auth(nil)
+	}
+
+	if err == nil {
+		err = conn.Hello()
+	}
+
+	if err != nil {
+		app.Logger().Warn("failed to connect to session bus, falling back to beeep notifications", "error", err)
+		if conn != nil {
+			conn.Close()
+		}
+
+		return nil
+	}
+
+	notifier, err := notify.New(conn, notify.WithOnClosed(svc.onClosed), notify.WithOnAction(svc.onAction))
+	if err != nil {
+		app.Logger().Warn("failed to create dbus notifier, falling back to beeep notifications", "error", err)
+		conn.Close()
+
+		return nil
+	}
+
+	svc.mu.Lock()
+	svc.conn = conn
+	svc.notifier = notifier
+	svc.mu.Unlock()
+
+	return nil
+}
+
+func (*dbusNotificationService) Run(ctx context.Context) error {
+	return nil
+}
+
+func (svc *dbusNotificationService) Shutdown() error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.notifier == nil {
+		return nil
+	}
+
+	err := svc.notifier.Close()
+	svc.conn.Close()
+	svc.notifier = nil
+	svc.conn = nil
+
+	return err
+}
+
+func (svc *dbusNotificationService) Send(n *services.Notification) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.notifier == nil {
+		svc.fallback.Send(n)
+		return
+	}
+
+	note := notify.Notification{
+		AppName:       svc.appName,
+		Summary:       n.Title,
+		Body:          n.Body,
+		ExpireTimeout: notify.ExpireTimeoutSetByNotificationServer,
+	}
+
+	if n.Key != "" {
+		note.ReplacesID = svc.ids[n.Key]
+	}
+
+	for _, a := range n.Actions {
+		note.Actions = append(note.Actions, notify.Action{Key: a.Id, Label: a.Label})
+	}
+
+	if n.Urgent {
+		note.SetUrgency(notify.UrgencyCritical)
+	} else {
+		note.SetUrgency(notify.UrgencyNormal)
+	}
+
+	switch n.Sound {
+	case services.NotificationSound_None:
+		note.AddHint(notify.Hint{ID: "suppress-sound", Variant: dbus.MakeVariant(true)})
+	case services.NotificationSound_Beep, services.NotificationSound_Alert:
+		note.AddHint(notify.HintSoundWithName("bell"))
+	}
+
+	if len(n.Icon) > 0 {
+		if rgba, err := decodeRGBA(n.Icon); err == nil {
+			note.AddHint(notify.HintImageDataRGBA(rgba))
+		} else {
+			app.Logger().Warn("failed to decode notification icon", "error", err)
+		}
+	}
+
+	id, err := svc.notifier.SendNotification(note)
+	if err != nil {
+		app.Logger().Error("failed to send dbus notification", "title", n.Title, "error", err)
+		return
+	}
+
+	if n.Key != "" {
+		svc.ids[n.Key] = id
+		svc.keys[id] = n.Key
+	}
+}
+
+// Actions are only delivered while connected to the session bus.
+func (svc *dbusNotificationService) SubscribeActions(keyPrefix string) <-chan services.NotificationActionEvent {
+	return svc.actions.subscribe(keyPrefix)
+}
+
+func (svc *dbusNotificationService) Dismiss(key string) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.notifier == nil {
+		return svc.fallback.Dismiss(key)
+	}
+
+	id, ok := svc.ids[key]
+	if !ok {
+		return false
+	}
+
+	delete(svc.ids, key)
+	delete(svc.keys, id)
+
+	if _, err := svc.notifier.CloseNotification(id); err != nil {
+		app.Logger().Error("failed to close dbus notification", "key", key, "error", err)
+		return false
+	}
+
+	return true
+}
+
+func (svc *dbusNotificationService) Notify(title, body string) {
+	svc.Send(&services.Notification{Title: title, Body: body})
+}
+
+func (svc *dbusNotificationService) NotifyWithIcon(title, body string, icon []byte) {
+	svc.Send(&services.Notification{Title: title, Body: body, Icon: icon})
+}
+
+func (svc *dbusNotificationService) onClosed(s *notify.NotificationClosedSignal) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if key, ok := svc.keys[s.ID]; ok {
+		delete(svc.keys, s.ID)
+		if svc.ids[key] == s.ID {
+			delete(svc.ids, key)
+		}
+	}
+}
+
+func (svc *dbusNotificationService) onAction(s *notify.ActionInvokedSignal) {
+	svc.mu.Lock()
+	key, ok := svc.keys[s.ID]
+	svc.mu.Unlock()
+
+	// Signals are received for the notifications of every application
+	if !ok {
+		return
+	}
+
+	svc.actions.dispatch(services.NotificationActionEvent{Key: key, ActionId: s.ActionKey})
+}
+
+func decodeRGBA(b []byte) (*image.RGBA, error) {
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	return rgba, nil
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || freebsd || netbsd || openbsd || illumos)
+
+package notification
+
+import "github.com/link00000000/gwsn/internal/services"
+
+// Creates the best notification service available on the platform.
+func NewDesktopNotificationService(appName string) services.NotificationService {
+	return NewBeeepNotificationService(appName)
+}
@@ -0,0 +1,342 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/dnd"
+	"github.com/link00000000/gwsn/internal/services"
+	"github.com/link00000000/gwsn/internal/state"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	dndStateKey = "notification/dnd"
+
+	// How often quiet hours are checked for having ended
+	dndCheckInterval = time.Minute
+
+	// Number of held notifications listed by name in the summary
+	maxDndSummaryEntries = 5
+	// Number of summarized notifications kept to be delivered when the summary
+	// is clicked
+	maxDndSummarized = 100
+
+	// The summary replaces the previous one, which it includes
+	dndSummaryKey = "dnd/summary"
+)
+
+type DndOptions struct {
+	// nil for no quiet hours, notifications are then only held while paused
+	Schedule *dnd.Schedule
+
+	// Case-insensitive substrings of the sender address, such as
+	// "alice@example.com" or "@example.com"
+	VipSenders []string
+	// Notifications with any of these labels are let through
+	VipLabels []string
+
+	// Keeps held notifications and the pause across restarts. May be nil.
+	State state.Store
+}
+
+// Persisted in DndOptions.State
+type dndState struct {
+	PausedUntil time.Time                `json:"pausedUntil"`
+	Held        []*services.Notification `json:"held,omitempty"`
+}
+
+// Holds notifications back during quiet hours and while paused, then delivers
+// them as a single summary once notifications resume. Clicking the summary
+// delivers the notifications in it. Notifications with buttons are delivered on
+// their own instead, so their actions are not lost, and expired ones are
+// dropped. Notifications from VIPs and ones that bypass do not disturb are
+// always let through.
+type dndNotificationService struct {
+	inner services.NotificationService
+	opts  DndOptions
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+	held        []*services.Notification
+	// In the summary that is shown, oldest first
+	summarized []*services.Notification
+	wake       chan struct{}
+}
+
+var _ services.DoNotDisturbService = (*dndNotificationService)(nil)
+
+func NewDndNotificationService(inner services.NotificationService, opts DndOptions) *dndNotificationService {
+	return &dndNotificationService{
+		inner: inner,
+		opts:  opts,
+		held:  make([]*services.Notification, 0),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func (svc *dndNotificationService) Setup() error {
+	if svc.opts.State != nil {
+		s := dndState{}
+		if _, err := svc.opts.State.Load(dndStateKey, &s); err != nil {
+			app.Logger().Warn("failed to restore do not disturb state", "error", err)
+		}
+
+		svc.mu.Lock()
+		svc.pausedUntil = s.PausedUntil
+		svc.held = append(svc.held, s.Held...)
+		svc.mu.Unlock()
+	}
+
+	return svc.inner.Setup()
+}
+
+func (svc *dndNotificationService) Run(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	summaryActions := svc.inner.SubscribeActions(dndSummaryKey)
+
+	g.Go(func() error { return svc.inner.Run(ctx) })
+	g.Go(func() error {
+		ticker := time.NewTicker(dndCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			svc.releaseIfQuietEnded(time.Now())
+
+			select {
+			case <-ticker.C:
+			case <-svc.wake:
+			case ev := <-summaryActions:
+				if ev.ActionId == services.NotificationActionId_Default {
+					svc.expandSummary()
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+func (svc *dndNotificationService) Shutdown() error {
+	return svc.inner.Shutdown()
+}
+
+func (svc *dndNotificationService) Send(n *services.Notification) {
+	svc.mu.Lock()
+
+	if !svc.isQuiet(time.Now()) || n.BypassDnd || svc.isVip(n) {
+		svc.mu.Unlock()
+		svc.inner.Send(n)
+		return
+	}
+
+	app.Logger().Debug("holding notification during quiet hours", "title", n.Title)
+
+	// A newer version of a held notification replaces it, like it would on
+	// screen
+	if i := svc.heldIndex(n.Key); i != -1 {
+		svc.held[i] = n
+	} else {
+		svc.held = append(svc.held, n)
+	}
+
+	svc.saveState()
+	svc.mu.Unlock()
+}
+
+// Held notifications are dismissed by dropping them from the summary.
+func (svc *dndNotificationService) Dismiss(key string) bool {
+	svc.mu.Lock()
+
+	if key != "" {
+		svc.summarized = slices.DeleteFunc(svc.summarized, func(n *services.Notification) bool { return n.Key == key })
+	}
+
+	if i := svc.heldIndex(key); i != -1 {
+		svc.held = slices.Delete(svc.held, i, i+1)
+		svc.saveState()
+		svc.mu.Unlock()
+
+		return true
+	}
+	svc.mu.Unlock()
+
+	return svc.inner.Dismiss(key)
+}
+
+func (svc *dndNotificationService) SubscribeActions(keyPrefix string) <-chan services.NotificationActionEvent {
+	return svc.inner.SubscribeActions(keyPrefix)
+}
+
+func (svc *dndNotificationService) Notify(title, body string) {
+	svc.Send(&services.Notification{Title: title, Body: body})
+}
+
+func (svc *dndNotificationService) NotifyWithIcon(title, body string, icon []byte) {
+	svc.Send(&services.Notification{Title: title, Body: body, Icon: icon})
+}
+
+func (svc *dndNotificationService) PauseUntil(t time.Time) {
+	svc.mu.Lock()
+	svc.pausedUntil = t
+	svc.saveState()
+	svc.mu.Unlock()
+
+	app.Logger().Info("notifications paused", "until", t)
+
+	// Resuming delivers the summary right away instead of on the next check
+	select {
+	case svc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (svc *dndNotificationService) PausedUntil() time.Time {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if time.Now().After(svc.pausedUntil) {
+		return time.Time{}
+	}
+
+	return svc.pausedUntil
+}
+
+func (svc *dndNotificationService) releaseIfQuietEnded(now time.Time) {
+	svc.mu.Lock()
+
+	if len(svc.held) == 0 || svc.isQuiet(now) {
+		svc.mu.Unlock()
+		return
+	}
+
+	held := svc.held
+	svc.held = make([]*services.Notification, 0)
+	svc.saveState()
+	svc.mu.Unlock()
+
+	app.Logger().Info("quiet hours ended, delivering held notifications", "numNotifications", len(held))
+
+	summarized := make([]*services.Notification, 0, len(held))
+	for _, n := range held {
+		switch {
+		case !n.Expires.IsZero() && !now.Before(n.Expires):
+			app.Logger().Debug("dropping held notification that expired", "title", n.Title, "expires", n.Expires)
+		case hasButtons(n):
+			svc.inner.Send(n)
+		default:
+			summarized = append(summarized, n)
+		}
+	}
+
+	if len(summarized) == 0 {
+		return
+	}
+
+	// Notifications in a summary that is still shown are carried over to the one
+	// replacing it
+	svc.mu.Lock()
+	svc.summarized = append(svc.summarized, summarized...)
+	if n := len(svc.summarized) - maxDndSummarized; n > 0 {
+		svc.summarized = slices.Delete(svc.summarized, 0, n)
+	}
+
+	summarized = slices.Clone(svc.summarized)
+	if len(summarized) == 1 {
+		svc.summarized = nil
+	}
+	svc.mu.Unlock()
+
+	if len(summarized) == 1 {
+		svc.inner.Send(summarized[0])
+		return
+	}
+
+	svc.inner.Send(dndSummary(summarized))
+}
+
+// Delivers the notifications of the summary on their own.
+func (svc *dndNotificationService) expandSummary() {
+	svc.mu.Lock()
+	summarized := svc.summarized
+	svc.summarized = nil
+	svc.mu.Unlock()
+
+	app.Logger().Debug("delivering summarized notifications", "numNotifications", len(summarized))
+
+	for _, n := range summarized {
+		svc.inner.Send(n)
+	}
+}
+
+// Must be called with svc.mu held.
+func (svc *dndNotificationService) isQuiet(now time.Time) bool {
+	return now.Before(svc.pausedUntil) || svc.opts.Schedule.IsQuiet(now)
+}
+
+// Whether any of the senders or labels of the notification is a VIP.
+func (svc *dndNotificationService) isVip(n *services.Notification) bool {
+	for _, sender := range n.Senders {
+		sender = strings.ToLower(sender)
+		if slices.ContainsFunc(svc.opts.VipSenders, func(vip string) bool { return strings.Contains(sender, strings.ToLower(vip)) }) {
+			return true
+		}
+	}
+
+	return slices.ContainsFunc(n.Labels, func(label string) bool { return slices.Contains(svc.opts.VipLabels, label) })
+}
+
+// Must be called with svc.mu held.
+func (svc *dndNotificationService) heldIndex(key string) int {
+	if key == "" {
+		return -1
+	}
+
+	return slices.IndexFunc(svc.held, func(n *services.Notification) bool { return n.Key == key })
+}
+
+// Must be called with svc.mu held.
+func (svc *dndNotificationService) saveState() {
+	if svc.opts.State == nil {
+		return
+	}
+
+	s := dndState{PausedUntil: svc.pausedUntil, Held: svc.held}
+	if err := svc.opts.State.Save(dndStateKey, &s); err != nil {
+		app.Logger().Error("failed to save do not disturb state", "error", err)
+	}
+}
+
+// Whether the notification has actions other than clicking it.
+func hasButtons(n *services.Notification) bool {
+	return slices.ContainsFunc(n.Actions, func(a services.NotificationAction) bool {
+		return a.Id != services.NotificationActionId_Default
+	})
+}
+
+func dndSummary(held []*services.Notification) *services.Notification {
+	lines := make([]string, 0, maxDndSummaryEntries+1)
+	for _, n := range held[:min(len(held), maxDndSummaryEntries)] {
+		lines = append(lines, n.Title)
+	}
+
+	if len(held) > maxDndSummaryEntries {
+		lines = append(lines, fmt.Sprintf("and %d more", len(held)-maxDndSummaryEntries))
+	}
+
+	return &services.Notification{
+		Key:     dndSummaryKey,
+		Title:   fmt.Sprintf("%d notifications while Do Not Disturb was on", len(held)),
+		Body:    strings.Join(lines, "\n"),
+		Urgent:  slices.ContainsFunc(held, func(n *services.Notification) bool { return n.Urgent }),
+		Actions: []services.NotificationAction{{Id: services.NotificationActionId_Default, Label: "Show all"}},
+	}
+}
@@ -0,0 +1,157 @@
+package notification
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+// Records the notifications it is sent instead of showing them
+type fakeNotificationService struct {
+	sent []*services.Notification
+}
+
+var _ services.NotificationService = (*fakeNotificationService)(nil)
+
+func (*fakeNotificationService) Setup() error                  { return nil }
+func (*fakeNotificationService) Run(ctx context.Context) error { return nil }
+func (*fakeNotificationService) Shutdown() error               { return nil }
+func (*fakeNotificationService) Dismiss(key string) bool       { return false }
+
+func (*fakeNotificationService) SubscribeActions(keyPrefix string) <-chan services.NotificationActionEvent {
+	return make(chan services.NotificationActionEvent)
+}
+
+func (s *fakeNotificationService) Send(n *services.Notification) {
+	s.sent = append(s.sent, n)
+}
+
+func (s *fakeNotificationService) Notify(title, body string) {
+	s.Send(&services.Notification{Title: title, Body: body})
+}
+
+func (s *fakeNotificationService) NotifyWithIcon(title, body string, icon []byte) {
+	s.Send(&services.Notification{Title: title, Body: body, Icon: icon})
+}
+
+func (s *fakeNotificationService) titles() []string {
+	titles := make([]string, len(s.sent))
+	for i, n := range s.sent {
+		titles[i] = n.Title
+	}
+
+	return titles
+}
+
+func TestDndLetsThrough(t *testing.T) {
+	tests := []struct {
+		name string
+		n    *services.Notification
+		want bool
+	}{
+		{name: "regular", n: &services.Notification{Title: "n", Senders: []string{"bob@example.com"}}},
+		{name: "vip among senders", n: &services.Notification{Title: "n", Senders: []string{"bob@example.com", "Alice@Example.com"}}, want: true},
+		{name: "vip domain", n: &services.Notification{Title: "n", Senders: []string{"carol@boss.example"}}, want: true},
+		{name: "vip label", n: &services.Notification{Title: "n", Labels: []string{"INBOX", "Label_7"}}, want: true},
+		{name: "bypass", n: &services.Notification{Title: "n", BypassDnd: true}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &fakeNotificationService{}
+			svc := NewDndNotificationService(inner, DndOptions{
+				VipSenders: []string{"alice@example.com", "@boss.example"},
+				VipLabels:  []string{"Label_7"},
+			})
+			svc.PauseUntil(time.Now().Add(time.Hour))
+
+			svc.Send(tt.n)
+
+			if got := len(inner.sent) == 1; got != tt.want {
+				t.Errorf("delivered during pause = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDndPauseExpires(t *testing.T) {
+	inner := &fakeNotificationService{}
+	svc := NewDndNotificationService(inner, DndOptions{})
+
+	now := time.Now()
+	svc.PauseUntil(now.Add(time.Hour))
+	svc.Send(&services.Notification{Title: "held"})
+
+	svc.releaseIfQuietEnded(now.Add(time.Minute * 30))
+	if len(inner.sent) != 0 {
+		t.Fatalf("delivered %q while paused", inner.titles())
+	}
+
+	svc.releaseIfQuietEnded(now.Add(time.Hour))
+	if got := inner.titles(); !slices.Equal(got, []string{"held"}) {
+		t.Errorf("delivered %q once the pause expired, want [held]", got)
+	}
+}
+
+func TestDndSummary(t *testing.T) {
+	inner := &fakeNotificationService{}
+	svc := NewDndNotificationService(inner, DndOptions{})
+
+	now := time.Now()
+	svc.PauseUntil(now.Add(time.Hour))
+
+	svc.Send(&services.Notification{Key: "gmail/a", Title: "a"})
+	svc.Send(&services.Notification{Key: "gmail/b", Title: "b"})
+	svc.Send(&services.Notification{Key: "gmail/c", Title: "c"})
+	svc.Send(&services.Notification{Key: "calendar/late", Title: "late", Expires: now.Add(time.Minute)})
+	svc.Send(&services.Notification{
+		Key:     "calendar/invite",
+		Title:   "invite",
+		Actions: []services.NotificationAction{{Id: services.NotificationActionId_Default}, {Id: "accept", Label: "Accept"}},
+	})
+
+	// Dismissed while held, so left out of the summary
+	svc.Dismiss("gmail/c")
+
+	svc.releaseIfQuietEnded(now.Add(time.Hour))
+
+	if got, want := inner.titles(), []string{"invite", "2 notifications while Do Not Disturb was on"}; !slices.Equal(got, want) {
+		t.Fatalf("delivered %q, want %q", got, want)
+	}
+
+	summary := inner.sent[1]
+	if summary.Key != dndSummaryKey {
+		t.Errorf("summary key = %q, want %q", summary.Key, dndSummaryKey)
+	}
+
+	if !slices.ContainsFunc(summary.Actions, func(a services.NotificationAction) bool { return a.Id == services.NotificationActionId_Default }) {
+		t.Errorf("summary actions = %+v, want a default action", summary.Actions)
+	}
+
+	// A later summary replaces the shown one and includes it
+	svc.PauseUntil(now.Add(time.Hour * 2))
+	svc.Send(&services.Notification{Key: "gmail/d", Title: "d"})
+	svc.Dismiss("gmail/a")
+	svc.releaseIfQuietEnded(now.Add(time.Hour * 2))
+
+	if got := inner.sent[len(inner.sent)-1]; got.Key != dndSummaryKey || got.Title != "2 notifications while Do Not Disturb was on" {
+		t.Fatalf("second summary = %+v, want b and d", got)
+	}
+
+	inner.sent = nil
+	svc.expandSummary()
+
+	if got := inner.titles(); !slices.Equal(got, []string{"b", "d"}) {
+		t.Errorf("clicking the summary delivered %q, want [b d]", got)
+	}
+
+	inner.sent = nil
+	svc.expandSummary()
+
+	if len(inner.sent) != 0 {
+		t.Errorf("clicking the summary again delivered %q, want nothing", inner.titles())
+	}
+}
@@ -0,0 +1,19 @@
+package notification
+
+import (
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+// Writes notifications to the application log.
+type logNotificationSink struct{}
+
+var _ services.NotificationSink = (*logNotificationSink)(nil)
+
+func NewLogNotificationSink() *logNotificationSink {
+	return &logNotificationSink{}
+}
+
+func (*logNotificationSink) Send(n *services.Notification) {
+	app.Logger().Info("notification", "title", n.Title, "body", n.Body, "urgent", n.Urgent)
+}
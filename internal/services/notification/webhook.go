@@ -0,0 +1,56 @@
+package notification
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+// Posts notifications as JSON to a url, for forwarding alerts from machines
+// without a desktop.
+type webhookNotificationSink struct {
+	url    string
+	client *http.Client
+}
+
+var _ services.NotificationSink = (*webhookNotificationSink)(nil)
+
+type webhookPayload struct {
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	Urgent bool   `json:"urgent"`
+}
+
+func NewWebhookNotificationSink(url string) *webhookNotificationSink {
+	return &webhookNotificationSink{
+		url:    url,
+		client: &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+func (s *webhookNotificationSink) Send(n *services.Notification) {
+	b, err := json.Marshal(webhookPayload{Title: n.Title, Body: n.Body, Urgent: n.Urgent})
+	if err != nil {
+		app.Logger().Error("failed to encode webhook notification", "error", err)
+		return
+	}
+
+	// Sent in the background so a slow endpoint doesn't hold up other
+	// notifications
+	go func() {
+		res, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+		if err != nil {
+			app.Logger().Error("failed to send webhook notification", "error", err)
+			return
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode >= 300 {
+			app.Logger().Error("webhook notification responded with error status", "status", res.Status)
+		}
+	}()
+}
@@ -1,6 +1,9 @@
 package services
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Service interface {
 	Setup() error
@@ -8,21 +11,164 @@ type Service interface {
 	Shutdown() error
 }
 
+// Service that calls Google Workspace APIs on behalf of the user.
+type GoogleService interface {
+	// OAuth scopes the service needs to be granted for the named account. nil if
+	// the service does not use the account.
+	Scopes(account string) []string
+}
+
 type GmailService interface {
 	Service
+	GoogleService
 }
 
 type GoogleCalendarService interface {
 	Service
+	GoogleService
+
+	// Whether the Gmail message is an invitation to an event that the calendar
+	// service of the account notifies about itself.
+	IsPendingInvitation(ctx context.Context, account string, email InvitationEmail) bool
+
+	// Events of every account between from and until, including ones that are
+	// ongoing at from, ordered by start time. Excludes declined events. Only
+	// events up to a day past the lookahead are known.
+	Agenda(from time.Time, until time.Time) []CalendarEntry
+	// Receives a value whenever the events returned by Agenda may have changed.
+	// Updates that are not received in time are combined.
+	AgendaUpdates() <-chan struct{}
+}
+
+// Gmail message that may be a calendar invitation.
+type InvitationEmail struct {
+	// UID of the event in the text/calendar part, empty if the message has none
+	ICalUID string
+	// Only used if ICalUID is empty
+	Subject     string
+	FromAddress string
+}
+
+// Calendar event as shown outside of notifications, such as in the system
+// tray.
+type CalendarEntry struct {
+	Title  string
+	Start  time.Time
+	End    time.Time
+	AllDay bool
+	// Opens the event in the Calendar web client
+	Link string
+	// Opens the video meeting of the event, empty if it has none
+	JoinLink string
+}
+
+type NotificationSound string
+
+const (
+	NotificationSound_Default NotificationSound = ""
+	NotificationSound_None    NotificationSound = "none"
+	NotificationSound_Beep    NotificationSound = "beep"
+	NotificationSound_Alert   NotificationSound = "alert"
+)
+
+func (s NotificationSound) IsValid() bool {
+	switch s {
+	case NotificationSound_Default, NotificationSound_None, NotificationSound_Beep, NotificationSound_Alert:
+		return true
+	default:
+		return false
+	}
+}
+
+// Id of the action invoked by clicking the notification itself. It is not
+// shown as a button.
+const NotificationActionId_Default = "default"
+
+// Button shown on a notification.
+type NotificationAction struct {
+	// Reported back in NotificationActionEvent.ActionId
+	Id    string
+	Label string
+}
+
+type Notification struct {
+	// Optional. Sending a notification with the same key as one that is still
+	// shown replaces it on backends that support it, instead of stacking a new
+	// one.
+	Key string
+
+	Title string
+	Body  string
+	// Optional, raw image data
+	Icon   []byte
+	Urgent bool
+	Sound  NotificationSound
+
+	// Optional, only shown by backends that support actions. Requires Key so
+	// the sender can tell which notification an action belongs to.
+	Actions []NotificationAction
+
+	// Optional, what the notification is about, such as the sender addresses and
+	// labels of every message it summarizes. Lets do not disturb tell VIP
+	// notifications apart.
+	Senders []string
+	Labels  []string
+	// Delivered even during quiet hours and while paused, for prompts that are
+	// useless once held such as sign-in codes
+	BypassDnd bool
+
+	// Optional, when the notification becomes pointless, such as a reminder once
+	// the event started. Held notifications are dropped after it instead of
+	// being delivered late.
+	Expires time.Time
+}
+
+// Sent when the user picks an action of a notification.
+type NotificationActionEvent struct {
+	Key      string
+	ActionId string
+}
+
+// Destination that notifications can be routed to.
+type NotificationSink interface {
+	Send(n *Notification)
+}
+
+// Implemented by sinks that can take back notifications they have sent.
+type NotificationDismisser interface {
+	// Closes the notification sent with key. Returns false if it is no longer
+	// shown or the backend can't close notifications.
+	Dismiss(key string) bool
 }
 
 type NotificationService interface {
 	Service
+	NotificationSink
+	NotificationDismisser
+
+	// Returns a channel that receives the actions picked on notifications whose
+	// key starts with keyPrefix.
+	SubscribeActions(keyPrefix string) <-chan NotificationActionEvent
 
 	Notify(title, body string)
 	NotifyWithIcon(title, body string, icon []byte)
 }
 
+// Notification service that holds notifications back during quiet hours.
+type DoNotDisturbService interface {
+	NotificationService
+
+	// Holds notifications until t, regardless of the schedule. The zero time
+	// resumes notifications.
+	PauseUntil(t time.Time)
+	// Zero if not paused
+	PausedUntil() time.Time
+}
+
 type SystemTrayService interface {
 	Service
+
+	// Shows or clears an indication that the named service is not working
+	// normally.
+	SetServiceDegraded(name string, degraded bool)
 }
@@ -0,0 +1,155 @@
+package systemtray
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getlantern/systray"
+	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/browser"
+	"github.com/link00000000/gwsn/internal/services"
+)
+
+// Submenu listing the remaining events of today. Menu items can't be removed,
+// so items are added as needed and hidden while they are not.
+type agendaMenu struct {
+	opener browser.Opener
+
+	entry *systray.MenuItem
+	items []*systray.MenuItem
+
+	mu sync.Mutex
+	// Shown by items, by index
+	entries []services.CalendarEntry
+
+	// Receives the event of the clicked item, as it was shown when clicked
+	clicked chan services.CalendarEntry
+}
+
+func newAgendaMenu(opener browser.Opener) *agendaMenu {
+	m := &agendaMenu{
+		opener:  opener,
+		entry:   systray.AddMenuItem("Today's agenda", ""),
+		clicked: make(chan services.CalendarEntry),
+	}
+
+	m.update(time.Now())
+
+	return m
+}
+
+// Rebuilds the items from the current events.
+func (m *agendaMenu) update(now time.Time) {
+	endOfDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	entries := app.GoogleCalendarService().Agenda(now, endOfDay)
+
+	m.mu.Lock()
+	m.entries = entries
+	m.mu.Unlock()
+
+	for len(m.items) < len(entries) {
+		item := m.entry.AddSubMenuItem("", "")
+		i := len(m.items)
+
+		go func() {
+			for range item.ClickedCh {
+				m.mu.Lock()
+				e, ok := m.entryAt(i)
+				m.mu.Unlock()
+
+				if ok {
+					m.clicked <- e
+				}
+			}
+		}()
+
+		m.items = append(m.items, item)
+	}
+
+	for i, item := range m.items {
+		if i >= len(entries) {
+			item.Hide()
+			continue
+		}
+
+		item.SetTitle(agendaItemTitle(now, entries[i]))
+		item.Show()
+	}
+
+	if len(entries) == 0 {
+		m.entry.SetTitle("No more events today")
+		m.entry.Disable()
+		return
+	}
+
+	m.entry.SetTitle("Today's agenda")
+	m.entry.Enable()
+}
+
+// Must be called with m.mu held.
+func (m *agendaMenu) entryAt(i int) (services.CalendarEntry, bool) {
+	if i >= len(m.entries) {
+		return services.CalendarEntry{}, false
+	}
+
+	return m.entries[i], true
+}
+
+// Opens the video meeting of the event, or the event itself if it has none.
+func (m *agendaMenu) open(e services.CalendarEntry) {
+	link := e.JoinLink
+	if link == "" {
+		link = e.Link
+	}
+
+	if err := m.opener.Open(link); err != nil {
+		app.Logger().Error("failed to open calendar event", "url", link, "error", err)
+	}
+}
+
+// Such as "Design review in 12m" for the next event that has not started yet.
+// Empty if there is none left today.
+func (m *agendaMenu) countdown(now time.Time) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.entries {
+		if e.AllDay || !e.Start.After(now) {
+			continue
+		}
+
+		return fmt.Sprintf("%s %s", e.Title, formatCountdown(e.Start.Sub(now)))
+	}
+
+	return ""
+}
+
+// Such as "10:00 Standup", "Now: Standup (until 10:30)" or "All day: Holiday".
+// Times are shown in the local timezone.
+func agendaItemTitle(now time.Time, e services.CalendarEntry) string {
+	switch {
+	case e.AllDay:
+		return "All day: " + e.Title
+	case !e.Start.After(now):
+		return fmt.Sprintf("Now: %s (until %s)", e.Title, e.End.In(time.Local).Format("15:04"))
+	default:
+		return fmt.Sprintf("%s %s", e.Start.In(time.Local).Format("15:04"), e.Title)
+	}
+}
+
+// Such as "in 12m" or "in 1h 5m", rounded up so that the countdown never shows
+// less time than is left.
+func formatCountdown(d time.Duration) string {
+	mins := int((d + time.Minute - 1) / time.Minute)
+
+	if mins < 60 {
+		return fmt.Sprintf("in %dm", mins)
+	}
+
+	if mins%60 == 0 {
+		return fmt.Sprintf("in %dh", mins/60)
+	}
+
+	return fmt.Sprintf("in %dh %dm", mins/60, mins%60)
+}
@@ -2,23 +2,44 @@ package systemtray
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/getlantern/systray"
 	"github.com/link00000000/gwsn/internal/app"
+	"github.com/link00000000/gwsn/internal/browser"
 	"github.com/link00000000/gwsn/internal/services"
 )
 
 type systraySystemTrayService struct {
 	title    string
 	trayIcon []byte
+	// Opens meeting and event links
+	opener browser.Opener
+
+	mu sync.Mutex
+	// Names of services that are currently degraded, sorted
+	degraded    []string
+	statusEntry *systray.MenuItem
+	// Time until the next event, such as "Design review in 12m"
+	countdown string
 }
 
 var _ services.SystemTrayService = (*systraySystemTrayService)(nil)
 
-func NewSystraySystemTrayService(title string, trayIcon []byte) *systraySystemTrayService {
+// Links are opened with opener, or in the user's default web browser if nil.
+func NewSystraySystemTrayService(title string, trayIcon []byte, opener browser.Opener) *systraySystemTrayService {
+	if opener == nil {
+		opener = browser.System
+	}
+
 	return &systraySystemTrayService{
 		title:    title,
 		trayIcon: trayIcon,
+		opener:   opener,
 	}
 }
 
@@ -31,11 +52,70 @@ func (svc *systraySystemTrayService) Run(ctx context.Context) error {
 		systray.SetIcon(svc.trayIcon)
 		systray.SetTitle(svc.title)
 
+		svc.mu.Lock()
+		svc.statusEntry = systray.AddMenuItem("", "")
+		svc.statusEntry.Disable()
+		svc.updateStatus()
+		svc.mu.Unlock()
+
+		join := newJoinMenu()
+		agenda := newAgendaMenu(svc.opener)
+		svc.setCountdown(agenda.countdown(time.Now()))
+
+		updateCalendar := func() {
+			now := time.Now()
+
+			join.update(now)
+			agenda.update(now)
+			svc.setCountdown(agenda.countdown(now))
+		}
+
+		pause := &dndMenu{}
+		if dnd, ok := app.NotificationService().(services.DoNotDisturbService); ok {
+			systray.AddSeparator()
+			pause = newDndMenu(dnd)
+		}
+
 		systray.AddSeparator()
 		exitEntry := systray.AddMenuItem("Exit", "")
 
+		// Clears the pause once it runs out, offers to join meetings as they come
+		// up and counts down to the next one
+		refresh := time.NewTicker(time.Minute)
+		defer refresh.Stop()
+
 		for {
 			select {
+			case <-pause.hourClicked:
+				pause.dnd.PauseUntil(time.Now().Add(time.Hour))
+				pause.update()
+
+			case <-pause.tomorrowClicked:
+				now := time.Now()
+				pause.dnd.PauseUntil(time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()))
+				pause.update()
+
+			case <-pause.resumeClicked:
+				pause.dnd.PauseUntil(time.Time{})
+				pause.update()
+
+			case <-join.entry.ClickedCh:
+				if join.link != "" {
+					if err := svc.opener.Open(join.link); err != nil {
+						app.Logger().Error("failed to open meeting link", "url", join.link, "error", err)
+					}
+				}
+
+			case e := <-agenda.clicked:
+				agenda.open(e)
+
+			case <-app.GoogleCalendarService().AgendaUpdates():
+				updateCalendar()
+
+			case <-refresh.C:
+				pause.update()
+				updateCalendar()
+
 			case <-exitEntry.ClickedCh:
 				app.RequestShutdown(true, "system tray exit menu entry clicked")
 
@@ -49,6 +129,139 @@ func (svc *systraySystemTrayService) Run(ctx context.Context) error {
 	return nil
 }
 
+// How long before it starts a meeting can be joined from the tray
+const joinWindow = time.Minute * 10
+
+// Entry for joining the video meeting that is ongoing or about to start. Hidden
+// while there is none.
+type joinMenu struct {
+	entry *systray.MenuItem
+	link  string
+}
+
+func newJoinMenu() *joinMenu {
+	m := &joinMenu{entry: systray.AddMenuItem("", "")}
+	m.update(time.Now())
+
+	return m
+}
+
+func (m *joinMenu) update(now time.Time) {
+	m.link = ""
+	title := ""
+
+	// The meeting that started last, a meeting about to start takes precedence
+	// over one that is running late
+	for _, e := range app.GoogleCalendarService().Agenda(now, now.Add(joinWindow)) {
+		if e.JoinLink != "" && !e.AllDay {
+			m.link, title = e.JoinLink, e.Title
+		}
+	}
+
+	if m.link == "" {
+		m.entry.Hide()
+		return
+	}
+
+	m.entry.SetTitle("Join " + title)
+	m.entry.Show()
+}
+
+// Entries for pausing notifications. The zero value has nil channels so that
+// it can be selected on when do not disturb is not available.
+type dndMenu struct {
+	dnd services.DoNotDisturbService
+
+	entry       *systray.MenuItem
+	resumeEntry *systray.MenuItem
+
+	hourClicked     <-chan struct{}
+	tomorrowClicked <-chan struct{}
+	resumeClicked   <-chan struct{}
+}
+
+func newDndMenu(dnd services.DoNotDisturbService) *dndMenu {
+	m := &dndMenu{dnd: dnd}
+
+	m.entry = systray.AddMenuItem("Pause notifications", "")
+	m.hourClicked = m.entry.AddSubMenuItem("For 1 hour", "").ClickedCh
+	m.tomorrowClicked = m.entry.AddSubMenuItem("Until tomorrow", "").ClickedCh
+	m.resumeEntry = systray.AddMenuItem("Resume notifications", "")
+	m.resumeClicked = m.resumeEntry.ClickedCh
+	m.update()
+
+	return m
+}
+
+func (m *dndMenu) update() {
+	if m.dnd == nil {
+		return
+	}
+
+	until := m.dnd.PausedUntil()
+	if until.IsZero() {
+		m.entry.SetTitle("Pause notifications")
+		m.resumeEntry.Hide()
+		return
+	}
+
+	m.entry.SetTitle(fmt.Sprintf("Notifications paused until %s", until.Format("Mon 15:04")))
+	m.resumeEntry.Show()
+}
+
 func (*systraySystemTrayService) Shutdown() error {
 	return nil
 }
+
+func (svc *systraySystemTrayService) SetServiceDegraded(name string, degraded bool) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	idx, found := slices.BinarySearch(svc.degraded, name)
+	switch {
+	case degraded && !found:
+		svc.degraded = slices.Insert(svc.degraded, idx, name)
+	case !degraded && found:
+		svc.degraded = slices.Delete(svc.degraded, idx, idx+1)
+	default:
+		return
+	}
+
+	svc.updateStatus()
+}
+
+func (svc *systraySystemTrayService) setCountdown(countdown string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.countdown == countdown {
+		return
+	}
+
+	svc.countdown = countdown
+	svc.updateStatus()
+}
+
+// Must be called with svc.mu held. Does nothing until the tray is ready.
+func (svc *systraySystemTrayService) updateStatus() {
+	if svc.statusEntry == nil {
+		return
+	}
+
+	tooltip := svc.title
+	if svc.countdown != "" {
+		tooltip = fmt.Sprintf("%s - %s", tooltip, svc.countdown)
+	}
+
+	if len(svc.degraded) == 0 {
+		svc.statusEntry.Hide()
+		systray.SetTooltip(tooltip)
+		return
+	}
+
+	status := fmt.Sprintf("Service degraded: %s", strings.Join(svc.degraded, ", "))
+
+	svc.statusEntry.SetTitle(status)
+	svc.statusEntry.Show()
+	systray.SetTooltip(fmt.Sprintf("%s - %s", tooltip, status))
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/link00000000/gwsn/internal/atomicfile"
+)
+
+// Key/value store for data that must survive restarts, such as sync positions.
+// Values are encoded as JSON.
+type Store interface {
+	// Decodes the value saved under key into v. Returns false if nothing has been
+	// saved under key.
+	Load(key string, v any) (bool, error)
+	Save(key string, v any) error
+}
+
+// Store backed by a single JSON file.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+var _ Store = (*FileStore)(nil)
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		path: path,
+	}
+}
+
+func (s *FileStore) Load(key string, v any) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.read()
+	if err != nil {
+		return false, err
+	}
+
+	raw, ok := entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, fmt.Errorf("failed to parse state entry (%s): %v", key, err)
+	}
+
+	return true, nil
+}
+
+func (s *FileStore) Save(key string, v any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode state entry (%s): %v", key, err)
+	}
+
+	entries[key] = raw
+
+	b, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode state file: %v", err)
+	}
+
+	if err := atomicfile.WriteFile(s.path, b); err != nil {
+		return fmt.Errorf("failed to write state file (%s): %v", s.path, err)
+	}
+
+	return nil
+}
+
+func (s *FileStore) read() (map[string]json.RawMessage, error) {
+	entries := make(map[string]json.RawMessage)
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file (%s): %v", s.path, err)
+	}
+
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse state file (%s): %v", s.path, err)
+	}
+
+	return entries, nil
+}
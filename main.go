@@ -2,29 +2,57 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/link00000000/gwsn/internal/app"
 	"github.com/link00000000/gwsn/internal/config"
+	"github.com/link00000000/gwsn/internal/dnd"
+	"github.com/link00000000/gwsn/internal/gworkspace"
+	"github.com/link00000000/gwsn/internal/rules"
+	"github.com/link00000000/gwsn/internal/services"
 	"github.com/link00000000/gwsn/internal/services/gmail"
 	"github.com/link00000000/gwsn/internal/services/googlecalendar"
 	"github.com/link00000000/gwsn/internal/services/notification"
 	"github.com/link00000000/gwsn/internal/services/systemtray"
 	"github.com/link00000000/gwsn/internal/services/systemtray/assets"
+	"github.com/link00000000/gwsn/internal/state"
 )
 
 const (
 	AppName = "Google Workspace Notify"
+
+	// Passphrase for encrypted token stores that don't set one in the config
+	TokenPassphraseEnvVar = "GWSN_TOKEN_PASSPHRASE"
 )
 
 var (
-	DefaultGmailPollingInterval = time.Minute * 5
+	DefaultGmailPollingInterval       = time.Minute * 5
+	DefaultGmailMaxCatchUpMessages    = 20
+	DefaultGmailBatchSize             = 50
+	DefaultGmailMaxConcurrentRequests = 4
+	DefaultGmailThreadCoalesceWindow  = time.Minute * 10
+
+	DefaultCalendarPollingInterval = time.Minute * 5
+	DefaultCalendarLookahead       = time.Hour * 24 * 7
+	DefaultCalendarChangeHorizon   = time.Hour * 24 * 7
 
 	DefaultConfig = config.InMemoryConfig{
 		Gmail: &config.GmailInMemoryConfig{
-			PollingInterval: &DefaultGmailPollingInterval,
+			PollingInterval:       &DefaultGmailPollingInterval,
+			MaxCatchUpMessages:    &DefaultGmailMaxCatchUpMessages,
+			BatchSize:             &DefaultGmailBatchSize,
+			MaxConcurrentRequests: &DefaultGmailMaxConcurrentRequests,
+			ThreadCoalesceWindow:  &DefaultGmailThreadCoalesceWindow,
+		},
+		Calendar: &config.CalendarInMemoryConfig{
+			PollingInterval: &DefaultCalendarPollingInterval,
+			Lookahead:       &DefaultCalendarLookahead,
+			ChangeHorizon:   &DefaultCalendarChangeHorizon,
 		},
 	}
 )
@@ -43,33 +71,293 @@ func main() {
 		os.Exit(1)
 	}
 
+	statePath, err := config.UserConfigRelFilePath("state.json").Resolve()
+	if err != nil {
+		app.Logger().Error("failed to resolve state file path", "error", err)
+		os.Exit(1)
+	}
+
+	stateStore := state.NewFileStore(statePath)
+
+	// Google accounts, shared by the gmail and calendar services
+	googleClients := make(map[string]*gworkspace.HttpClient, len(cfg.Gmail.Accounts))
+	for _, acc := range cfg.Gmail.Accounts {
+		client, err := newGoogleClient(acc)
+		if err != nil {
+			app.Logger().Error("failed to create google api client", "account", acc.Name, "error", err)
+			os.Exit(1)
+		}
+
+		googleClients[acc.Name] = client
+	}
+
+	// Rules may only route to sinks that exist
+	sinkNames := make([]string, len(cfg.Notifications.Sinks))
+	for i, s := range cfg.Notifications.Sinks {
+		sinkNames[i] = s.Name
+	}
+
 	// Gmail service
+	gmailRules, err := newGmailRules(cfg.Gmail.Rules, sinkNames)
+	if err != nil {
+		app.Logger().Error("failed to load gmail rules", "error", err)
+		os.Exit(1)
+	}
+
 	gmailAccounts := make([]gmail.Account, len(cfg.Gmail.Accounts))
 	for i, acc := range cfg.Gmail.Accounts {
+		accRules, err := newGmailRules(acc.Rules, sinkNames)
+		if err != nil {
+			app.Logger().Error("failed to load gmail rules", "account", acc.Name, "error", err)
+			os.Exit(1)
+		}
+
+		// Account rules are evaluated before the global ones
+		ruleSet, err := rules.NewRuleSet(accRules, gmailRules)
+		if err != nil {
+			app.Logger().Error("invalid gmail rules", "account", acc.Name, "error", err)
+			os.Exit(1)
+		}
+
 		gmailAccounts[i] = gmail.Account{
-			Name: acc.Name,
-			Creds: gmail.AccountCredentials{
-				TokenType:    acc.TokenType,
-				AccessToken:  acc.AccessToken,
-				RefreshToken: acc.RefreshToken,
-				Expiry:       acc.Expiry,
-				ExpiresIn:    acc.ExpiresIn,
+			Name:   acc.Name,
+			Client: googleClients[acc.Name],
+			Labels: gworkspace.GmailLabelFilter{
+				Include: acc.IncludeLabels,
+				Exclude: acc.ExcludeLabels,
 			},
+			Rules:       ruleSet,
+			HasCalendar: slices.Contains(cfg.Calendar.Accounts, acc.Name),
+		}
+
+		if acc.Digest != nil {
+			gmailAccounts[i].Digest = &gmail.DigestOptions{
+				Window:      acc.Digest.Window,
+				MaxMessages: acc.Digest.MaxMessages,
+			}
+		}
+	}
+
+	gmailActions := make([]gmail.MessageAction, len(cfg.Gmail.NotificationActions))
+	for i, a := range cfg.Gmail.NotificationActions {
+		gmailActions[i] = gmail.MessageAction(a)
+		if !gmailActions[i].IsValid() {
+			app.Logger().Error("unknown gmail notification action", "action", a)
+			os.Exit(1)
 		}
 	}
 
-	app.RegisterGmailService(gmail.NewService(cfg.Gmail.PollingInterval, gmailAccounts))
+	app.RegisterGmailService(gmail.NewService(gmail.Options{
+		PollingInterval:       cfg.Gmail.PollingInterval,
+		MaxCatchUpMessages:    cfg.Gmail.MaxCatchUpMessages,
+		BatchSize:             cfg.Gmail.BatchSize,
+		MaxConcurrentRequests: cfg.Gmail.MaxConcurrentRequests,
+		ThreadCoalesceWindow:  cfg.Gmail.ThreadCoalesceWindow,
+		State:                 stateStore,
+		NotificationActions:   gmailActions,
+	}, gmailAccounts))
 
 	// Google calendar service
-	app.RegisterGoogleCalendarService(googlecalendar.NewService())
+	calendarAccounts := make([]googlecalendar.Account, len(cfg.Calendar.Accounts))
+	for i, name := range cfg.Calendar.Accounts {
+		client, ok := googleClients[name]
+		if !ok {
+			app.Logger().Error("calendar account is not configured in gmail accounts", "account", name)
+			os.Exit(1)
+		}
+
+		calendarAccounts[i] = googlecalendar.Account{
+			Name:   name,
+			Client: client,
+		}
+	}
+
+	app.RegisterGoogleCalendarService(googlecalendar.NewService(googlecalendar.Options{
+		PollingInterval: cfg.Calendar.PollingInterval,
+		Lookahead:       cfg.Calendar.Lookahead,
+		ChangeHorizon:   cfg.Calendar.ChangeHorizon,
+		State:           stateStore,
+	}, calendarAccounts))
 
 	// Notification service
-	app.RegisterNotificationService(notification.NewBeeepNotificationService(AppName))
+	dndSchedule, err := newDndSchedule(cfg.Dnd)
+	if err != nil {
+		app.Logger().Error("invalid do not disturb schedule", "error", err)
+		os.Exit(1)
+	}
+
+	notificationSvc := notification.NewDndNotificationService(notification.NewDesktopNotificationService(AppName), notification.DndOptions{
+		Schedule:   dndSchedule,
+		VipSenders: cfg.Dnd.VipSenders,
+		VipLabels:  cfg.Dnd.VipLabels,
+		State:      stateStore,
+	})
+	app.RegisterNotificationService(notificationSvc)
+
+	for _, s := range cfg.Notifications.Sinks {
+		switch s.Type {
+		case "desktop":
+			app.RegisterNotificationSink(s.Name, notificationSvc)
+		case "log":
+			app.RegisterNotificationSink(s.Name, notification.NewLogNotificationSink())
+		case "webhook":
+			app.RegisterNotificationSink(s.Name, notification.NewWebhookNotificationSink(s.Url))
+		default:
+			app.Logger().Error("unknown notification sink type", "sink", s.Name, "type", s.Type)
+			os.Exit(1)
+		}
+	}
 
 	// System tray service
-	app.RegisterSystemTrayService(systemtray.NewSystraySystemTrayService(AppName, assets.TrayIcon))
+	app.RegisterSystemTrayService(systemtray.NewSystraySystemTrayService(AppName, assets.TrayIcon, nil))
 
 	if err := app.Run(context.Background()); err != nil {
 		panic(err)
 	}
 }
+
+// Builds the rules and checks that they are valid, so that mistakes in the
+// config are reported on start.
+func newGmailRules(cfgs []config.GmailRuleConfig, sinkNames []string) ([]rules.Rule, error) {
+	gmailRules := make([]rules.Rule, len(cfgs))
+	for i, r := range cfgs {
+		gmailRules[i] = rules.Rule{
+			Name: r.Name,
+			Match: rules.Match{
+				From:           r.Match.From,
+				To:             r.Match.To,
+				Cc:             r.Match.Cc,
+				Subject:        r.Match.Subject,
+				Labels:         r.Match.Labels,
+				ListId:         r.Match.ListId,
+				HasAttachments: r.Match.HasAttachments,
+			},
+			Action: rules.Action{
+				Type:   rules.ActionType(r.Action.Type),
+				Urgent: r.Action.Urgent,
+				Sound:  services.NotificationSound(r.Action.Sound),
+				Sink:   r.Action.Sink,
+			},
+		}
+
+		if r.Action.Icon != "" {
+			icon, err := os.ReadFile(r.Action.Icon)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read icon for rule %s: %v", r.Name, err)
+			}
+
+			gmailRules[i].Action.Icon = icon
+		}
+
+		if r.Action.Sink != "" && !slices.Contains(sinkNames, r.Action.Sink) {
+			return nil, fmt.Errorf("unknown notification sink in rule %s: %s", r.Name, r.Action.Sink)
+		}
+	}
+
+	return gmailRules, nil
+}
+
+func newDndSchedule(cfg config.DndConfig) (*dnd.Schedule, error) {
+	var err error
+
+	// LoadLocation would treat an empty name as UTC
+	loc := time.Local
+	if cfg.Timezone != "" {
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown timezone %s: %v", cfg.Timezone, err)
+		}
+	}
+
+	schedule := &dnd.Schedule{
+		Location: loc,
+		Periods:  make([]dnd.Period, len(cfg.QuietHours)),
+	}
+
+	for i, p := range cfg.QuietHours {
+		for _, d := range p.Days {
+			day, err := dnd.ParseWeekday(d)
+			if err != nil {
+				return nil, err
+			}
+
+			schedule.Periods[i].Days = append(schedule.Periods[i].Days, day)
+		}
+
+		if schedule.Periods[i].Start, err = dnd.ParseClock(p.Start); err != nil {
+			return nil, err
+		}
+
+		if schedule.Periods[i].End, err = dnd.ParseClock(p.End); err != nil {
+			return nil, err
+		}
+	}
+
+	return schedule, nil
+}
+
+func newGoogleClient(acc config.GmailAccountConfig) (*gworkspace.HttpClient, error) {
+	store, err := newTokenStore(acc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token store: %v", err)
+	}
+
+	creds := gworkspace.AccountCredentials{
+		TokenType:    acc.TokenType,
+		AccessToken:  acc.AccessToken,
+		RefreshToken: acc.RefreshToken,
+		Expiry:       acc.Expiry,
+		ExpiresIn:    acc.ExpiresIn,
+	}
+
+	tok, err := creds.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build oauth token from account credentials: %v", err)
+	}
+
+	flow, err := gworkspace.NewAuthFlow(gworkspace.AuthFlowType(acc.AuthFlow), func(userCode, verificationUrl string) {
+		// The code expires long before quiet hours end, so it is never held
+		app.NotificationService().Send(&services.Notification{
+			Key:       "auth/" + acc.Name,
+			Title:     fmt.Sprintf("Authorize %s", acc.Name),
+			Body:      fmt.Sprintf("Enter code %s at %s", userCode, verificationUrl),
+			Urgent:    true,
+			BypassDnd: true,
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth flow: %v", err)
+	}
+
+	return gworkspace.NewHttpClient(acc.Name, tok, store, flow), nil
+}
+
+func newTokenStore(acc config.GmailAccountConfig) (gworkspace.TokenStore, error) {
+	switch gworkspace.TokenStoreType(acc.TokenStore) {
+	case "", gworkspace.TokenStoreType_File:
+		path, err := config.UserConfigRelFilePath(filepath.Join("tokens", acc.Name+".json")).Resolve()
+		if err != nil {
+			return nil, err
+		}
+
+		return gworkspace.NewFileTokenStore(path), nil
+
+	case gworkspace.TokenStoreType_EncryptedFile:
+		path, err := config.UserConfigRelFilePath(filepath.Join("tokens", acc.Name+".json.enc")).Resolve()
+		if err != nil {
+			return nil, err
+		}
+
+		passphrase := acc.TokenStorePassphrase
+		if passphrase == "" {
+			passphrase = os.Getenv(TokenPassphraseEnvVar)
+		}
+
+		return gworkspace.NewEncryptedFileTokenStore(path, passphrase), nil
+
+	case gworkspace.TokenStoreType_Keyring:
+		return gworkspace.NewKeyringTokenStore(AppName, "gmail:"+acc.Name), nil
+
+	default:
+		return nil, fmt.Errorf("unknown token store type: %s", acc.TokenStore)
+	}
+}